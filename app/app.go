@@ -2,68 +2,282 @@
 package app
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
-	"github.com/rodaine/table"
 	"github.com/urfave/cli/v2"
 
+	"github.com/mojochao/emacsctl/archive"
 	"github.com/mojochao/emacsctl/cache"
 	"github.com/mojochao/emacsctl/config"
+	"github.com/mojochao/emacsctl/daemon"
 	"github.com/mojochao/emacsctl/errors"
+	"github.com/mojochao/emacsctl/render"
+	"github.com/mojochao/emacsctl/schema"
+	"github.com/mojochao/emacsctl/shellwords"
 	"github.com/mojochao/emacsctl/state"
+	"github.com/mojochao/emacsctl/templates"
+	"github.com/mojochao/emacsctl/toml"
 	"github.com/mojochao/emacsctl/util"
 )
 
 // appDirFlag is the flag used to specify an alternate application directory
 var appDirFlag = cli.StringFlag{
-	Name:        "app-dir",
-	Usage:       "Specify application directory",
-	Destination: &config.AppDir,
-	Value:       config.DefaultAppDir,
-	EnvVars:     []string{"EMACSCFG_DIR"},
+	Name:    "app-dir",
+	Usage:   "Specify application directory",
+	Value:   config.DefaultAppDir,
+	EnvVars: []string{"EMACSCTL_DIR", "EMACSCFG_DIR"},
+}
+
+// stateFileFlag is the flag used to specify a state file outside the application directory.
+var stateFileFlag = cli.StringFlag{
+	Name:    "state-file",
+	Aliases: []string{"config-file"},
+	Usage:   "Specify application state file, taking precedence over --app-dir",
+	EnvVars: []string{"EMACSCTL_STATE_FILE"},
+}
+
+// cacheDirFlag is the flag used to specify an alternate application cache directory.
+var cacheDirFlag = cli.StringFlag{
+	Name:    "cache-dir",
+	Usage:   "Specify application cache directory of cloned git repositories (default: \"~/.cache/emacsctl\")",
+	EnvVars: []string{"EMACSCTL_CACHE_DIR"},
+}
+
+// localFlag is the flag used to force use of a project-local state file.
+var localFlag = cli.BoolFlag{
+	Name:  "local",
+	Usage: "Use the project-local state file, creating it in the current directory if none is found",
+}
+
+// globalFlag is the flag used to force use of the state file in the application directory.
+var globalFlag = cli.BoolFlag{
+	Name:  "global",
+	Usage: "Use the state file in the application directory, ignoring any project-local state file",
 }
 
 // dryRunFlag is the flag used to specify commands to be printed but not executed.
 var dryRunFlag = cli.BoolFlag{
-	Name:        "dry-run",
-	Usage:       "Display the command that would be executed, but do not execute it",
-	Destination: &config.DryRun,
+	Name:  "dry-run",
+	Usage: "Display the command that would be executed, but do not execute it",
 }
 
 // verboseFlag is the flag used to specify increased output.
 var verboseFlag = cli.BoolFlag{
-	Name:        "verbose",
-	Aliases:     []string{"v"},
-	Usage:       "Display verbose output",
-	Destination: &config.Verbose,
+	Name:    "verbose",
+	Aliases: []string{"v"},
+	Usage:   "Display verbose output",
+}
+
+// quietFlag is the flag used to suppress non-essential output.
+var quietFlag = cli.BoolFlag{
+	Name:    "quiet",
+	Aliases: []string{"q"},
+	Usage:   "Suppress success messages and list output, takes precedence over --verbose",
+}
+
+// logLevelFlag is the flag used to specify the level of diagnostics logged to stderr.
+var logLevelFlag = cli.StringFlag{
+	Name:    "log-level",
+	Usage:   "Level of diagnostics logged to stderr (error, info, debug), info with --verbose",
+	Value:   "error",
+	EnvVars: []string{"EMACSCTL_LOG_LEVEL"},
+}
+
+// timeoutFlag is the flag used to specify the maximum duration of git operations.
+var timeoutFlag = cli.DurationFlag{
+	Name:  "timeout",
+	Usage: "Maximum duration of any single git operation",
+	Value: config.DefaultGitTimeout,
+}
+
+// noColorFlag is the flag used to disable colorized output.
+var noColorFlag = cli.BoolFlag{
+	Name:  "no-color",
+	Usage: "Disable colorized output, also disabled by NO_COLOR or when not writing to a terminal",
+}
+
+// yesFlag is the flag used to skip confirmation prompts of remove commands.
+var yesFlag = cli.BoolFlag{
+	Name:    "yes",
+	Aliases: []string{"y"},
+	Usage:   "Do not ask for confirmation, also skipped when standard input is not a terminal",
+}
+
+// noVerifyFlag is the flag used to skip checking the emacs binary of a command.
+var noVerifyFlag = cli.BoolFlag{
+	Name:  "no-verify",
+	Usage: "Do not check that the emacs binary exists or record its version, for commands used on other machines",
 }
 
 // contextFlag is the flag used to provide name of an environment context to
 // use instead of any active environment context found in the state.
 var contextFlag = cli.StringFlag{
-	Name:        "context",
-	Aliases:     []string{"c"},
-	Usage:       "Use a specific environment context",
-	Destination: &config.Context,
+	Name:    "context",
+	Aliases: []string{"c"},
+	Usage:   "Use a specific environment context",
+}
+
+// outputFlag is the flag used to specify the output format of list commands.
+var outputFlag = cli.StringFlag{
+	Name:    "output",
+	Aliases: []string{"o"},
+	Usage:   "Output format (" + strings.Join(render.Formats, ", ") + ")",
+	Value:   render.Table,
+}
+
+// formatFlag is the flag used to specify a template printing each row of list commands.
+var formatFlag = cli.StringFlag{
+	Name:  "format",
+	Usage: "Go template printing each row instead of --output, e.g. '{{.Name}}: {{.Description}}'",
+}
+
+// sortFlag is the flag used to specify the column list commands sort by.
+var sortFlag = cli.StringFlag{
+	Name:  "sort",
+	Usage: "Column to sort by (name, description)",
+	Value: "name",
+}
+
+// Runner runs the processes the application launches, such as emacs, so that
+// they can be observed or replaced when the application is embedded or tested.
+type Runner interface {
+	// Start starts a command without waiting for it to exit.
+	Start(cmd *exec.Cmd) error
+	// Wait waits for a command started with Start to exit.
+	Wait(cmd *exec.Cmd) error
+	// StartDetached starts a command detached from the terminal without waiting for it.
+	StartDetached(cmd *exec.Cmd) error
+}
+
+// osRunner is the Runner executing commands as operating system processes.
+type osRunner struct{}
+
+func (osRunner) Start(cmd *exec.Cmd) error         { return cmd.Start() }
+func (osRunner) Wait(cmd *exec.Cmd) error          { return cmd.Wait() }
+func (osRunner) StartDetached(cmd *exec.Cmd) error { return util.StartDetached(cmd) }
+
+// loggingRunner is a Runner logging the commands another Runner starts.
+type loggingRunner struct {
+	Runner
+}
+
+func (r loggingRunner) Start(cmd *exec.Cmd) error {
+	logCommand(cmd)
+	return r.Runner.Start(cmd)
+}
+
+func (r loggingRunner) StartDetached(cmd *exec.Cmd) error {
+	logCommand(cmd)
+	return r.Runner.StartDetached(cmd)
+}
+
+// logCommand logs the full argv, directory, and environment of a command at debug level.
+func logCommand(cmd *exec.Cmd) {
+	slog.Debug("exec", "argv", cmd.Args, "dir", cmd.Dir, "env", cmd.Env)
+}
+
+// logResolved logs how an environment resolved at info level.
+func logResolved(env *state.ResolvedEnvironment) {
+	slog.Info("resolved environment", "name", env.Name, "command", env.Environment.CommandName,
+		"bin_path", env.Command.BinPath, "config", env.Environment.ConfigName, "init_dir", env.Config.InitDir)
+}
+
+// runnerKey is the key of the application runner in the app metadata.
+const runnerKey = "runner"
+
+// SetRunner sets the runner an application created by New launches processes with.
+func SetRunner(app *cli.App, runner Runner) {
+	app.Metadata[runnerKey] = runner
+}
+
+// appRunner returns the runner of the application, executing commands as
+// operating system processes unless another was set with SetRunner. The
+// commands it starts are logged at debug level.
+func appRunner(c *cli.Context) Runner {
+	if runner, ok := c.App.Metadata[runnerKey].(Runner); ok {
+		return loggingRunner{runner}
+	}
+	return loggingRunner{osRunner{}}
+}
+
+// runCommand runs a command with a runner, waiting for it to exit.
+func runCommand(runner Runner, cmd *exec.Cmd) error {
+	if err := runner.Start(cmd); err != nil {
+		return err
+	}
+	return runner.Wait(cmd)
+}
+
+// runWith returns a function running commands with a runner, waiting for them
+// to exit, for the packages running commands of their own.
+func runWith(runner Runner) func(cmd *exec.Cmd) error {
+	return func(cmd *exec.Cmd) error { return runCommand(runner, cmd) }
 }
 
 // New creates a new cli application.
 func New() *cli.App {
 	return &cli.App{
 		Name:        config.AppName,
+		Metadata:    map[string]any{runnerKey: osRunner{}},
 		Usage:       "Manage multiple emacs environments",
 		Description: config.AppDescription,
+		Before:      before,
+		// Complete subcommands, flags, and environment names of flag values in shells.
+		EnableBashCompletion: true,
+		// Emacs arguments may contain commas, so repeated flags must not be split on them.
+		DisableSliceFlagSeparator: true,
 		Flags: []cli.Flag{
 			&appDirFlag,
+			&stateFileFlag,
+			&cacheDirFlag,
+			&localFlag,
+			&globalFlag,
 			&dryRunFlag,
 			&verboseFlag,
+			&quietFlag,
+			&logLevelFlag,
+			&timeoutFlag,
+			&noColorFlag,
 		},
 		Commands: []*cli.Command{
+			{
+				Name:   "init",
+				Usage:  "Set up application state with a default command, config, and environment",
+				Action: initState,
+				Before: lockState,
+				After:  unlockState,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "emacs-path",
+						Usage: "Path of the emacs binary to use instead of detecting it",
+					},
+					&cli.StringFlag{
+						Name:  "config-dir",
+						Usage: "Emacs configuration directory path or git URL to use instead of prompting for it",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Overwrite any existing application state",
+					},
+					&noVerifyFlag,
+				},
+			},
 			{
 				Name:  "state",
 				Usage: "Display application state",
@@ -73,6 +287,12 @@ func New() *cli.App {
 						Aliases: []string{"cat", "view"},
 						Usage:   "Display the content of the application state file",
 						Action:  showState,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "only",
+								Usage: "Display only part of the application state (context)",
+							},
+						},
 					},
 					{
 						Name:    "path",
@@ -80,6 +300,93 @@ func New() *cli.App {
 						Usage:   "Display the path of the application state file",
 						Action:  showStatePath,
 					},
+					{
+						Name:   "schema",
+						Usage:  "Display the JSON Schema of the application state file for editor validation",
+						Action: showStateSchema,
+					},
+					{
+						Name:   "edit",
+						Usage:  "Edit the application state file in $EDITOR",
+						Action: editState,
+						Before: lockState,
+						After:  unlockState,
+					},
+					{
+						Name:      "import",
+						Usage:     "Merge the content of another application state file into the application state",
+						Action:    importState,
+						Before:    lockState,
+						After:     unlockState,
+						Args:      true,
+						ArgsUsage: "FILE",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "dedup",
+								Usage: "Reuse existing commands and configs identical to imported ones instead of adding duplicates",
+							},
+							&cli.StringFlag{
+								Name:  "archive",
+								Usage: "Archive written by state export to import instead of FILE, unpacking its configurations",
+							},
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "Format of FILE (json, toml), detected from its extension by default",
+							},
+						},
+					},
+					{
+						Name:   "export",
+						Usage:  "Print the application state, or bundle it and its local configuration directories into an archive",
+						Action: exportState,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "archive",
+								Usage: "Path of the gzipped tar archive to write instead of printing the state",
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Output format of the printed state (json, toml)",
+								Value:   "json",
+							},
+						},
+					},
+					{
+						Name:      "diff",
+						Usage:     "Display the differences between the application state and another application state file",
+						Action:    diffState,
+						Args:      true,
+						ArgsUsage: "FILE",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Output format (text, json)",
+								Value:   "text",
+							},
+						},
+					},
+					{
+						Name:   "restore",
+						Usage:  "Swap the application state file with its backup",
+						Action: restoreState,
+						Before: lockState,
+						After:  unlockState,
+					},
+					{
+						Name:   "reset",
+						Usage:  "Replace the application state with the default state, backing it up first",
+						Action: resetState,
+						Before: lockState,
+						After:  unlockState,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Reset the application state instead of refusing to",
+							},
+						},
+					},
 				},
 			},
 			{
@@ -92,11 +399,22 @@ func New() *cli.App {
 						Aliases: []string{"ls"},
 						Usage:   "Display table of all emacs environments in application state",
 						Action:  listEnvironments,
+						Flags: []cli.Flag{
+							&outputFlag,
+							&formatFlag,
+							&sortFlag,
+							&cli.BoolFlag{
+								Name:  "wide",
+								Usage: "Display resolved command lines and init directories, whether each init directory exists, and when each environment was created and last updated",
+							},
+						},
 					},
 					{
 						Name:      "add",
 						Usage:     "Add a new emacs environment to application state",
 						Action:    addEnvironment,
+						Before:    lockState,
+						After:     unlockState,
 						Args:      true,
 						ArgsUsage: "NAME",
 						Flags: []cli.Flag{
@@ -108,7 +426,7 @@ func New() *cli.App {
 							&cli.StringFlag{
 								Name:    "commandline",
 								Aliases: []string{"cmdline"},
-								Usage:   "New emacs command line to use for environment",
+								Usage:   "New emacs command line to use for environment, added as a command named after it",
 							},
 							&cli.StringFlag{
 								Name:    "config",
@@ -118,13 +436,150 @@ func New() *cli.App {
 							&cli.StringFlag{
 								Name:    "configdir",
 								Aliases: []string{"cfgdir"},
-								Usage:   "New emacs configuration directory path to use for environment",
+								Usage:   "New emacs configuration directory path or git URL to use for environment, added as a config named after it",
+							},
+							&cli.StringFlag{
+								Name:    "description",
+								Aliases: []string{"desc"},
+								Usage:   "Description of the environment",
+							},
+							&cli.StringSliceFlag{
+								Name:  "arg",
+								Usage: "Extra emacs argument to append to the command's own arguments (repeatable)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "env",
+								Usage: "Environment variable as KEY=VALUE to set when opening emacs (repeatable)",
+							},
+							&cli.StringFlag{
+								Name:  "working-dir",
+								Usage: "Directory to start emacs in when opening the environment",
+							},
+							&cli.StringFlag{
+								Name:  "env-file",
+								Usage: "Dotenv file of KEY=VALUE lines loaded when opening emacs, overridden by --env",
+							},
+							&cli.StringFlag{
+								Name:  "pre",
+								Usage: "Shell command run with sh -c before opening the environment, aborting if it fails",
+							},
+							&cli.StringFlag{
+								Name:  "post",
+								Usage: "Shell command run with sh -c after emacs opened in the environment exits, unless detached",
+							},
+							&cli.StringFlag{
+								Name:  "title",
+								Usage: "Title of the emacs frames opened in the environment",
+							},
+							&cli.StringFlag{
+								Name:  "extends",
+								Usage: "Name of a parent environment to inherit the settings not provided from",
+							},
+						},
+					},
+					{
+						Name:      "activate",
+						Aliases:   []string{"use"},
+						Usage:     "Set an emacs environment as the active environment context",
+						Action:    activateEnvironment,
+						Before:    lockState,
+						After:     unlockState,
+						Args:      true,
+						ArgsUsage: "NAME",
+					},
+					{
+						Name:      "update",
+						Usage:     "Update an existing emacs environment in application state",
+						Action:    updateEnvironment,
+						Before:    lockState,
+						After:     unlockState,
+						Args:      true,
+						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "command",
+								Aliases: []string{"cmd"},
+								Usage:   "Name of existing emacs command to use for environment",
+							},
+							&cli.StringFlag{
+								Name:    "config",
+								Aliases: []string{"cfg"},
+								Usage:   "Name of existing emacs configuration to use for environment",
 							},
 							&cli.StringFlag{
 								Name:    "description",
 								Aliases: []string{"desc"},
 								Usage:   "Description of the environment",
 							},
+							&cli.StringSliceFlag{
+								Name:  "arg",
+								Usage: "Extra emacs argument replacing the environment's extra arguments (repeatable)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "env",
+								Usage: "Environment variable as KEY=VALUE replacing the environment's variables (repeatable)",
+							},
+							&cli.StringFlag{
+								Name:  "working-dir",
+								Usage: "Directory to start emacs in when opening the environment",
+							},
+							&cli.StringFlag{
+								Name:  "env-file",
+								Usage: "Dotenv file of KEY=VALUE lines loaded when opening emacs, overridden by --env",
+							},
+							&cli.StringFlag{
+								Name:  "pre",
+								Usage: "Shell command run with sh -c before opening the environment, aborting if it fails",
+							},
+							&cli.StringFlag{
+								Name:  "post",
+								Usage: "Shell command run with sh -c after emacs opened in the environment exits, unless detached",
+							},
+							&cli.StringFlag{
+								Name:  "title",
+								Usage: "Title of the emacs frames opened in the environment",
+							},
+							&cli.StringFlag{
+								Name:  "extends",
+								Usage: "Name of a parent environment to inherit the settings not provided from",
+							},
+						},
+					},
+					{
+						Name:      "show",
+						Usage:     "Display details of an emacs environment and how it resolves",
+						Action:    showEnvironment,
+						Args:      true,
+						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Output format (text, json)",
+								Value:   "text",
+							},
+						},
+					},
+					{
+						Name:      "default",
+						Usage:     "Display or set the emacs environment opened when there is no context",
+						Action:    defaultEnvironment,
+						Before:    lockState,
+						After:     unlockState,
+						Args:      true,
+						ArgsUsage: "[NAME]",
+					},
+					{
+						Name:      "command",
+						Usage:     "Print the command line opening an emacs environment would run",
+						Action:    showEnvironmentCommand,
+						Args:      true,
+						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "join",
+								Usage: "Print the command line space-joined on a single line",
+							},
 						},
 					},
 					{
@@ -132,8 +587,25 @@ func New() *cli.App {
 						Aliases:   []string{"rm"},
 						Usage:     "Remove an existing environment from application state",
 						Action:    removeEnvironment,
+						Before:    lockState,
+						After:     unlockState,
 						Args:      true,
 						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&yesFlag,
+							&cli.BoolFlag{
+								Name:  "cascade",
+								Usage: "Also remove the command and config of the environment if no other environment uses them",
+							},
+							&cli.BoolFlag{
+								Name:  "dangling",
+								Usage: "Remove even if environments extend it, leaving them dangling",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Remove even if it is the active context, clearing it",
+							},
+						},
 					},
 				},
 			},
@@ -147,28 +619,100 @@ func New() *cli.App {
 						Aliases: []string{"ls"},
 						Usage:   "Display table of all emacs commands in application state",
 						Action:  listCommands,
+						Flags: []cli.Flag{
+							&outputFlag,
+							&formatFlag,
+							&sortFlag,
+							&cli.BoolFlag{
+								Name:  "wide",
+								Usage: "Display when each command was created and last updated",
+							},
+							&cli.BoolFlag{
+								Name:  "usage",
+								Usage: "Display the environments using each command",
+							},
+						},
 					},
 					{
 						Name:      "add",
 						Usage:     "Add a new emacs command line to application state",
 						Action:    addCommand,
+						Before:    lockState,
+						After:     unlockState,
 						Args:      true,
-						ArgsUsage: "NAME CMD_LINE",
+						ArgsUsage: "NAME [CMD_LINE]",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
 								Name:    "description",
 								Aliases: []string{"desc"},
 								Usage:   "Description of the command line",
 							},
+							&cli.StringFlag{
+								Name:  "shell",
+								Usage: "Command line split with shell quoting rules instead of CMD_LINE",
+							},
+							&cli.StringFlag{
+								Name:  "client",
+								Usage: "Emacs client command line used to connect to servers started by the command",
+							},
+							&cli.BoolFlag{
+								Name:  "detect-emacs",
+								Usage: "Detect installed emacs binaries and use the chosen one instead of CMD_LINE",
+							},
+							&cli.StringFlag{
+								Name:  "from",
+								Usage: "Name of existing emacs command to copy the command line of instead of CMD_LINE",
+							},
+							&cli.StringSliceFlag{
+								Name:  "arg",
+								Usage: "Argument appended to the command line copied with --from, may be repeated",
+							},
+							&noVerifyFlag,
+						},
+					},
+					{
+						Name:      "show",
+						Usage:     "Display details of an emacs command and its rendered command line",
+						Action:    showCommand,
+						Args:      true,
+						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "config",
+								Aliases: []string{"cfg"},
+								Usage:   "Name of existing emacs configuration to render the command line with",
+							},
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Output format (text, json)",
+								Value:   "text",
+							},
 						},
 					},
+					{
+						Name:      "test",
+						Usage:     "Verify that an emacs command launches by running it with --version",
+						Action:    testCommand,
+						Args:      true,
+						ArgsUsage: "NAME",
+					},
 					{
 						Name:      "remove",
 						Aliases:   []string{"rm"},
 						Usage:     "Remove an existing emacs command from application state",
 						Action:    removeCommand,
+						Before:    lockState,
+						After:     unlockState,
 						Args:      true,
 						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&yesFlag,
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Remove even if environments still use it, leaving them dangling",
+							},
+						},
 					},
 				},
 			},
@@ -182,19 +726,127 @@ func New() *cli.App {
 						Aliases: []string{"ls"},
 						Usage:   "Display table of all emacs configurations in application state",
 						Action:  listConfigs,
+						Flags: []cli.Flag{
+							&outputFlag,
+							&formatFlag,
+							&sortFlag,
+							&cli.BoolFlag{
+								Name:  "sort-by-size",
+								Usage: "Sort by size of cached repository, largest first, and display a size column",
+							},
+							&cli.BoolFlag{
+								Name:  "wide",
+								Usage: "Display when each configuration was created and last updated",
+							},
+							&cli.BoolFlag{
+								Name:  "usage",
+								Usage: "Display the environments using each configuration",
+							},
+						},
 					},
 					{
 						Name:      "add",
 						Usage:     "Add a new emacs configuration directory to application state",
 						Action:    addConfig,
+						Before:    lockState,
+						After:     unlockState,
 						Args:      true,
-						ArgsUsage: "NAME DIR_PATH",
+						ArgsUsage: "NAME [DIR_PATH]",
 						Flags: []cli.Flag{
 							&cli.StringFlag{
 								Name:    "description",
 								Aliases: []string{"desc"},
 								Usage:   "Description of the configuration directory",
 							},
+							&cli.StringFlag{
+								Name:  "template",
+								Usage: "Clone a well-known starter kit instead of DIR_PATH (" + strings.Join(templates.Names(), ", ") + ")",
+							},
+							&cli.StringSliceFlag{
+								Name:  "source",
+								Usage: "Directory or git URL composed into the configuration instead of DIR_PATH, later sources taking precedence (repeatable)",
+							},
+							&cli.StringFlag{
+								Name:  "post-checkout",
+								Usage: "Command line to run in a git-backed configuration after every clone or update",
+							},
+							&cli.IntFlag{
+								Name:  "depth",
+								Usage: "Shallow clone a git-backed configuration with this many commits, kept on update",
+							},
+							&cli.BoolFlag{
+								Name:  "trust",
+								Usage: "Trust and run the post-checkout command after the initial clone",
+							},
+							&cli.BoolFlag{
+								Name:  "no-cache",
+								Usage: "Record a git-backed configuration without cloning it, leaving that to config fetch",
+							},
+						},
+					},
+					{
+						Name:      "path",
+						Usage:     "Print the init directory of an emacs configuration",
+						Action:    showConfigPath,
+						Args:      true,
+						ArgsUsage: "NAME",
+					},
+					{
+						Name:         "open",
+						Aliases:      []string{"edit"},
+						Usage:        "Open the directory of an emacs configuration to edit it in the desired emacs environment",
+						Action:       openConfig,
+						BashComplete: completeEnvironmentFlags,
+						Args:         true,
+						ArgsUsage:    "NAME",
+						Flags: []cli.Flag{
+							&contextFlag,
+							&cli.StringFlag{
+								Name:    "env",
+								Aliases: []string{"e"},
+								Usage:   "Use a specific environment to edit with, overriding any context",
+							},
+						},
+					},
+					{
+						Name:      "status",
+						Usage:     "Display whether git-backed emacs configurations are behind their remotes",
+						Action:    showConfigStatus,
+						Args:      true,
+						ArgsUsage: "[NAME...]",
+						Flags: []cli.Flag{
+							&outputFlag,
+							&formatFlag,
+							&cli.BoolFlag{
+								Name:  "offline",
+								Usage: "Do not fetch from remotes, report the last fetched state",
+							},
+						},
+					},
+					{
+						Name:      "update",
+						Aliases:   []string{"update-cache"},
+						Usage:     "Pull the latest changes into a git-backed emacs configuration",
+						Action:    updateConfig,
+						Args:      true,
+						ArgsUsage: "NAME",
+					},
+					{
+						Name:      "fetch",
+						Usage:     "Clone git-backed emacs configurations not yet in the cache, or all of them if none are named",
+						Action:    fetchConfigs,
+						Before:    lockState,
+						After:     unlockState,
+						ArgsUsage: "[NAME...]",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Clone again configurations already in the cache",
+							},
+							&cli.BoolFlag{
+								Name:  "trust",
+								Usage: "Trust and run the post-checkout commands after cloning",
+							},
 						},
 					},
 					{
@@ -202,8 +854,30 @@ func New() *cli.App {
 						Aliases:   []string{"rm"},
 						Usage:     "Remove an existing emacs configuration from application state",
 						Action:    removeConfig,
+						Before:    lockState,
+						After:     unlockState,
 						Args:      true,
 						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&yesFlag,
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Remove even if environments still use it, leaving them dangling",
+							},
+						},
+					},
+					{
+						Name:   "gc",
+						Usage:  "Remove cached repositories of emacs configurations no longer in application state",
+						Action: collectConfigGarbage,
+						Before: lockState,
+						After:  unlockState,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Remove orphaned cached repositories instead of only listing them",
+							},
+						},
 					},
 				},
 			},
@@ -217,10 +891,21 @@ func New() *cli.App {
 						Usage:  "Get the active environment context",
 						Action: getContext,
 					},
+					{
+						Name:         "show",
+						Usage:        "Display how the active environment context resolves",
+						Action:       showContext,
+						BashComplete: completeEnvironmentFlags,
+						Flags: []cli.Flag{
+							&contextFlag,
+						},
+					},
 					{
 						Name:      "set",
 						Usage:     "Set the active environment context",
 						Action:    setContext,
+						Before:    lockState,
+						After:     unlockState,
 						Args:      true,
 						ArgsUsage: "ENV",
 					},
@@ -228,18 +913,203 @@ func New() *cli.App {
 						Name:   "clear",
 						Usage:  "Clear the active environment context",
 						Action: clearContext,
+						Before: lockState,
+						After:  unlockState,
+					},
+					{
+						Name:   "back",
+						Usage:  "Switch back to the previous environment context, like cd -",
+						Action: previousContext,
+						Before: lockState,
+						After:  unlockState,
+					},
+					{
+						Name:   "history",
+						Usage:  "Display the previous environment contexts, most recent first",
+						Action: showContextHistory,
 					},
 				},
 			},
 			{
-				Name:      "open",
-				Aliases:   []string{"edit"},
-				Usage:     "Open files in the desired emacs environment",
-				Action:    openEmacs,
-				Args:      true,
-				ArgsUsage: "[FILES...]",
+				Name:         "open",
+				Aliases:      []string{"edit"},
+				Usage:        "Open files in the desired emacs environment",
+				Action:       openEmacs,
+				BashComplete: completeEnvironmentFlags,
+				Args:         true,
+				ArgsUsage:    "[@ENV] [FILES...]",
+				Flags: []cli.Flag{
+					&contextFlag,
+					&cli.StringFlag{
+						Name:    "env",
+						Aliases: []string{"e"},
+						Usage:   "Use a specific environment for this launch only, overriding any context",
+					},
+					&cli.BoolFlag{
+						Name:    "detach",
+						Aliases: []string{"d"},
+						Usage:   "Start emacs detached from the terminal and return immediately",
+					},
+					&cli.StringFlag{
+						Name:  "cwd",
+						Usage: "Directory to start emacs in, overriding the environment's working directory",
+					},
+					&cli.StringFlag{
+						Name:  "after-init",
+						Usage: "Command line to run once emacs has been started",
+					},
+					&cli.DurationFlag{
+						Name:  "after-init-delay",
+						Usage: "Time to wait after starting emacs before running the after init command",
+						Value: time.Second,
+					},
+					&cli.BoolFlag{
+						Name:  "client",
+						Usage: "Open files with emacs client in a server for the environment, starting it if needed",
+					},
+					&cli.BoolFlag{
+						Name:    "reuse-or-new",
+						Aliases: []string{"reuse"},
+						Usage:   "Open a new frame of a running emacs server for the environment without waiting, else start a new emacs",
+					},
+					&cli.BoolFlag{
+						Name:  "wait",
+						Usage: "Return only once emacs exits, or once the buffers opened with emacs client are done",
+					},
+					&cli.BoolFlag{
+						Name:  "no-wait",
+						Usage: "Return once emacs is started, or once emacs client has opened the files, without waiting for them",
+					},
+					&cli.StringSliceFlag{
+						Name:  "eval",
+						Usage: "Emacs lisp form to evaluate after loading the configuration (repeatable)",
+					},
+					&cli.BoolFlag{
+						Name:  "batch",
+						Usage: "Run emacs non-interactively in batch mode, which does not load the init file of the configuration",
+					},
+					&cli.BoolFlag{
+						Name:  "print",
+						Usage: "Print the command line like --dry-run does, but still open emacs",
+					},
+				},
+			},
+			{
+				Name:         "run",
+				Usage:        "Run an emacs lisp script in batch mode in the desired emacs environment",
+				Action:       runScript,
+				BashComplete: completeEnvironmentFlags,
+				Args:         true,
+				ArgsUsage:    "[@ENV] SCRIPT",
 				Flags: []cli.Flag{
 					&contextFlag,
+					&cli.StringFlag{
+						Name:    "env",
+						Aliases: []string{"e"},
+						Usage:   "Use a specific environment for this run only, overriding any context",
+					},
+				},
+			},
+			{
+				Name:      "search",
+				Aliases:   []string{"grep"},
+				Usage:     "Search commands, configurations, and environments by name and description",
+				Action:    search,
+				Args:      true,
+				ArgsUsage: "TERM",
+				Flags: []cli.Flag{
+					&outputFlag,
+					&formatFlag,
+					&cli.BoolFlag{
+						Name:  "regex",
+						Usage: "Treat TERM as a regular expression",
+					},
+				},
+			},
+			{
+				Name:   "prune",
+				Usage:  "Remove environments referencing missing commands or configurations and any dangling context",
+				Action: prune,
+				Before: lockState,
+				After:  unlockState,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Remove dangling references instead of only listing them",
+					},
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "Inspect cached git repositories of emacs configurations",
+				Subcommands: []*cli.Command{
+					{
+						Name:    "list",
+						Aliases: []string{"ls"},
+						Usage:   "Display table of all cached repositories",
+						Action:  listCache,
+						Flags: []cli.Flag{
+							&outputFlag,
+							&formatFlag,
+						},
+					},
+					{
+						Name:      "info",
+						Usage:     "Display information about a cached repository",
+						Action:    showCacheInfo,
+						Args:      true,
+						ArgsUsage: "NAME",
+						Flags: []cli.Flag{
+							&outputFlag,
+							&formatFlag,
+						},
+					},
+					{
+						Name:   "size",
+						Usage:  "Display disk usage of all cached repositories",
+						Action: showCacheSize,
+						Flags: []cli.Flag{
+							&outputFlag,
+							&formatFlag,
+						},
+					},
+				},
+			},
+			{
+				Name:   "alias",
+				Usage:  "Print shell functions opening each emacs environment by name, for sourcing in a shell rc file",
+				Action: showAliases,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "shell",
+						Usage: "Shell to print functions for (" + strings.Join(aliasShells, ", ") + ")",
+						Value: "bash",
+					},
+				},
+			},
+			{
+				Name:   "completion",
+				Usage:  "Print a shell completion script, for sourcing in a shell rc file",
+				Action: showCompletion,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "shell",
+						Usage: "Shell to print the completion script for (" + strings.Join(completionShells, ", ") + ")",
+						Value: "bash",
+					},
+				},
+			},
+			{
+				Name:   "info",
+				Usage:  "Print application version, paths, context, and emacs binary for bug reports",
+				Action: showAppInfo,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Output format (text, json)",
+						Value:   "text",
+					},
 				},
 			},
 			{
@@ -251,10 +1121,177 @@ func New() *cli.App {
 	}
 }
 
+// before prepares the application to run any command.
+func before(c *cli.Context) error {
+	// Build the configuration from the global flags for commands to read.
+	conf := &config.Config{
+		AppDir:     c.String("app-dir"),
+		StateFile:  c.String("state-file"),
+		CacheDir:   c.String("cache-dir"),
+		Local:      c.Bool("local"),
+		Global:     c.Bool("global"),
+		DryRun:     c.Bool("dry-run"),
+		Verbose:    c.Bool("verbose"),
+		Quiet:      c.Bool("quiet"),
+		NoColor:    c.Bool("no-color"),
+		GitTimeout: c.Duration("timeout"),
+	}
+	c.App.Metadata[configKey] = conf
+	config.Current = conf
+
+	// Quiet wins over verbose so scripts can rely on it regardless of other flags.
+	if conf.Quiet {
+		conf.Verbose = false
+	}
+
+	// Log diagnostics to stderr at the requested level, verbose implying info.
+	level, err := parseLogLevel(c.String("log-level"))
+	if err != nil {
+		return err
+	}
+	if conf.Verbose && !c.IsSet("log-level") {
+		level = slog.LevelInfo
+	}
+	conf.LogLevel = level
+	slog.SetDefault(newLogger(level))
+
+	// Disable colors when requested or when they would end up as escape codes in a file.
+	if conf.NoColor || os.Getenv("NO_COLOR") != "" || !util.IsTerminal(os.Stdout) {
+		color.NoColor = true
+	}
+
+	// Expand the application directory before any path is derived from it.
+	if err := conf.ResolveAppDir(); err != nil {
+		return err
+	}
+
+	// Use any project-local state file unless told otherwise.
+	if err := selectLocalState(c); err != nil {
+		return err
+	}
+
+	slog.Debug("using paths", "app_dir", conf.AppDir, "state_file", conf.StatePath(), "cache_dir", conf.CachePath())
+	return ensureAppDir(c)
+}
+
+// logLevels maps the values of the --log-level flag to log levels.
+var logLevels = map[string]slog.Level{
+	"error": slog.LevelError,
+	"info":  slog.LevelInfo,
+	"debug": slog.LevelDebug,
+}
+
+// parseLogLevel returns the log level named by a value of the --log-level flag.
+func parseLogLevel(name string) (slog.Level, error) {
+	level, ok := logLevels[strings.ToLower(name)]
+	if !ok {
+		return 0, errors.InvalidValueError{Name: "log-level", Value: name}
+	}
+	return level, nil
+}
+
+// newLogger returns a logger writing records of at least a level to stderr as
+// text, leaving out the time that is of no use for a short-lived command.
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}))
+}
+
+// configKey is the key of the application configuration in the app metadata.
+const configKey = "config"
+
+// unlockKey is the key in the app metadata of the function releasing the state
+// file lock acquired by lockState, if any.
+const unlockKey = "unlock"
+
+// appConfig returns the application configuration built from the global flags
+// by before, or the current configuration if before has not run.
+func appConfig(c *cli.Context) *config.Config {
+	if conf, ok := c.App.Metadata[configKey].(*config.Config); ok {
+		return conf
+	}
+	return config.Current
+}
+
+// selectLocalState uses the nearest project-local state file found in the
+// current directory or its parents, unless --global is provided or a state
+// file or application directory is explicitly specified. With --local, a
+// project-local state file in the current directory is used if none is found.
+// The precedence is --state-file, then --app-dir, then project-local state.
+func selectLocalState(c *cli.Context) error {
+	conf := appConfig(c)
+
+	if conf.Local && conf.Global {
+		return errors.ConflictingFlagsError{First: "--local", Second: "--global"}
+	}
+	if conf.StateFile != "" || c.IsSet("app-dir") {
+		if conf.Local {
+			return errors.ConflictingFlagsError{First: "--local", Second: "--state-file or --app-dir"}
+		}
+		return nil
+	}
+	if conf.Global {
+		return nil
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if path, found := config.FindLocalStatePath(cwd); found {
+		conf.StateFile = path
+		return nil
+	}
+	if conf.Local {
+		conf.StateFile = config.LocalStatePath(cwd)
+		return util.EnsureDir(filepath.Dir(conf.StateFile))
+	}
+	return nil
+}
+
+// ensureAppDir ensures the application directory is known before running any
+// command, which is not the case if the home directory cannot be determined
+// and no --app-dir flag is provided.
+func ensureAppDir(c *cli.Context) error {
+	conf := appConfig(c)
+
+	if conf.AppDir == "" && conf.StateFile == "" {
+		return errors.NoHomeDirError
+	}
+	return nil
+}
+
+// lockState acquires the state file lock before running a command mutating the state file.
+func lockState(c *cli.Context) error {
+	unlock, err := state.Lock(appConfig(c).StatePath(), state.LockTimeout)
+	if err != nil {
+		return err
+	}
+	c.App.Metadata[unlockKey] = unlock
+	return nil
+}
+
+// unlockState releases the state file lock after running a command mutating the state file.
+func unlockState(c *cli.Context) error {
+	unlock, ok := c.App.Metadata[unlockKey].(func() error)
+	if !ok {
+		return nil
+	}
+	delete(c.App.Metadata, unlockKey)
+	return unlock()
+}
+
 // listEnvironments prints a table of all environments in the state file.
-func listEnvironments(_ *cli.Context) error {
+func listEnvironments(c *cli.Context) error {
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(appConfig(c).StatePath())
 	if err != nil {
 		return err
 	}
@@ -264,22 +1301,66 @@ func listEnvironments(_ *cli.Context) error {
 		return nil
 	}
 
-	// Otherwise, print a pretty table of all environments.
-	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
-	columnFmt := color.New(color.FgYellow).SprintfFunc()
-	tbl := table.New("Name", "Command", "Config", "Description")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
-	for name, environment := range appState.Environments {
-		tbl.AddRow(name, environment.CommandName, environment.ConfigName, environment.Description)
+	// If requested, print environments with their resolved paths instead.
+	if c.Bool("wide") {
+		return listEnvironmentsWide(c, appState)
 	}
 
-	tbl.Print()
-	return nil
+	// Otherwise, print all environments in the desired output format.
+	rows := make([][]string, 0, len(appState.Environments))
+	for name, environment := range appState.Environments {
+		if effective, err := appState.Effective(name); err == nil {
+			environment = effective
+		}
+		row := []string{name, environment.CommandName, environment.ConfigName, environment.Description}
+		if withTimestamps(c) {
+			row = append(row, environment.CreatedAt, environment.UpdatedAt)
+		}
+		rows = append(rows, row)
+	}
+	headers := []string{"Name", "Command", "Config", "Description"}
+	if withTimestamps(c) {
+		headers = append(headers, timestampHeaders...)
+	}
+	if err := sortRows(rows, headers, c.String("sort")); err != nil {
+		return err
+	}
+	return renderEntityRows(c, headers, rows, appState.Environments)
+}
 
+// listEnvironmentsWide prints a table of all environments in the state file
+// with the resolved binary path and arguments of their command, the init
+// directory of their configuration, whether that directory exists on disk,
+// and when they were created and last updated.
+func listEnvironmentsWide(c *cli.Context, appState *state.State) error {
+	rows := make([][]string, 0, len(appState.Environments))
+	for name, environment := range appState.Environments {
+		if effective, err := appState.Effective(name); err == nil {
+			environment = effective
+		}
+		commandLine, initDir, exists := "", "", "✗"
+		if command, ok := appState.Commands[environment.CommandName]; ok {
+			commandLine = strings.Join(append([]string{command.BinPath}, command.BinArgs...), " ")
+		}
+		if cfg, ok := appState.Configs[environment.ConfigName]; ok {
+			initDir = cfg.InitDir
+			if info, err := os.Stat(initDir); err == nil && info.IsDir() {
+				exists = "✓"
+			}
+		}
+		rows = append(rows, []string{name, environment.CommandName, commandLine, environment.ConfigName, initDir, exists, environment.Description, environment.CreatedAt, environment.UpdatedAt})
+	}
+	headers := append([]string{"Name", "Command", "Command Line", "Config", "Init Dir", "Exists", "Description"}, timestampHeaders...)
+	if err := sortRows(rows, headers, c.String("sort")); err != nil {
+		return err
+	}
+	return renderEntityRows(c, headers, rows, appState.Environments)
 }
 
 // addEnvironment adds a new environment to the state file.
 func addEnvironment(c *cli.Context) error {
+	conf := appConfig(c)
+
 	// Verify correct usage.
 	if c.NArg() != 1 {
 		return errors.UnexpectedNumArgsError{
@@ -288,51 +1369,66 @@ func addEnvironment(c *cli.Context) error {
 		}
 	}
 	name := c.Args().Get(0)
-
-	// Load the application state.
-	appState, err := state.Load(config.StatePath())
-	if err != nil {
+	// Environments extending another may inherit their command and config instead.
+	checkFlags := exactlyOneFlag
+	if c.String("extends") != "" {
+		checkFlags = atMostOneFlag
+	}
+	if err := checkFlags(c, "command", "commandline"); err != nil {
 		return err
 	}
-
-	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
-		return nil
+	if err := checkFlags(c, "config", "configdir"); err != nil {
+		return err
 	}
 
-	// Get the optional command line, configuration directory, and description from the flags.
-	commandName := c.String("command")
-	if _, ok := appState.Commands[commandName]; !ok {
-		return errors.CommandNotFoundError{Name: commandName}
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
 	}
 
-	configName := c.String("config")
-	if _, ok := appState.Configs[configName]; !ok {
-		return errors.ConfigNotFoundError{Name: configName}
+	// Stage all changes in a transaction, so that a failure midway leaves
+	// neither orphaned commands and configs nor cloned repositories behind.
+	tx := appState.Begin()
+	if err := stageEnvironment(c, tx, name); err != nil {
+		return rollback(tx, err)
 	}
 
-	description := c.String("description")
-	if description == "" {
-		description = "Not specified"
+	// If is a dry run, print what would be added and discard the changes.
+	if conf.DryRun {
+		env, err := tx.State.Effective(name)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		fmt.Printf("would add environment: %s (command %s, config %s)\n", name, env.CommandName, env.ConfigName)
+		return tx.Rollback()
 	}
 
-	// Add the environment to the application state and save it back to the state file.
-	if err := appState.AddEnvironment(name, commandName, configName, description); err != nil {
-		return err
-	}
-	if err := state.Save(appState, config.StatePath()); err != nil {
-		return err
+	// Otherwise, save the changes back to the state file.
+	if err := state.Save(tx.State, conf.StatePath()); err != nil {
+		return rollback(tx, err)
 	}
+	tx.Commit()
 
 	// Success!
-	if config.Verbose {
+	if conf.Verbose {
 		fmt.Printf("added environment: %s\n", name)
 	}
 	return nil
 }
 
-// removeEnvironment removes an environment from the state file.
-func removeEnvironment(c *cli.Context) error {
+// environmentDetails represents the details of an environment displayed by showEnvironment.
+type environmentDetails struct {
+	*state.ResolvedEnvironment
+	CommandLine []string `json:"command_line"`
+	GitBacked   bool     `json:"git_backed"`
+	Cached      bool     `json:"cached"`
+}
+
+// showEnvironment prints the details of an environment in the state file.
+func showEnvironment(c *cli.Context) error {
+	conf := appConfig(c)
+
 	// Verify correct usage.
 	if c.NArg() != 1 {
 		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
@@ -340,100 +1436,95 @@ func removeEnvironment(c *cli.Context) error {
 	name := c.Args().Get(0)
 
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(conf.StatePath())
 	if err != nil {
 		return err
 	}
 
-	// Find the environment in the application state.
-	if _, exists := appState.Environments[name]; !exists {
-		return errors.EnvironmentNotFoundError{Name: name}
+	// Resolve the environment's command and config.
+	env, err := appState.Resolve(name)
+	if err != nil {
+		return err
+	}
+	gitBacked := isGitBacked(conf, env.Config)
+	details := environmentDetails{
+		ResolvedEnvironment: env,
+		CommandLine:         env.CommandLine(),
+		GitBacked:           gitBacked,
+		Cached:              gitBacked && isFetched(conf, env.Environment.ConfigName, env.Config),
 	}
 
-	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
+	// Print the details in the requested format.
+	switch output := c.String("output"); output {
+	case "json":
+		return printJSON(details)
+	case "text":
+		fmt.Printf("name:         %s\n", details.Name)
+		fmt.Printf("description:  %s\n", details.Environment.Description)
+		if len(details.Ancestors) > 0 {
+			fmt.Printf("extends:      %s\n", strings.Join(details.Ancestors, " -> "))
+		}
+		fmt.Printf("command:      %s (%s)\n", details.Environment.CommandName, details.Command.BinPath)
+		fmt.Printf("config:       %s (%s)\n", details.Environment.ConfigName, details.Config.InitDir)
+		fmt.Printf("git-backed:   %t\n", details.GitBacked)
+		fmt.Printf("cached:       %t\n", details.Cached)
+		fmt.Printf("command line: %s\n", strings.Join(details.CommandLine, " "))
 		return nil
+	default:
+		return errors.InvalidValueError{Name: "output", Value: output}
 	}
+}
 
-	// Remove the environment from the application state and save it back to the state file.
-	if err := appState.RemoveEnvironment(name); err != nil {
-		return err
-	}
-	if err := state.Save(appState, config.StatePath()); err != nil {
-		return err
-	}
+// defaultEnvironment prints the default environment of the state file, or
+// sets it if a name is provided.
+func defaultEnvironment(c *cli.Context) error {
+	conf := appConfig(c)
 
-	// Success!
-	if config.Verbose {
-		fmt.Printf("removed environment: %s\n", name)
+	// Verify correct usage.
+	if c.NArg() > 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
 	}
-	return nil
-}
 
-// listCommands prints a table of all commands in the state file.
-func listCommands(_ *cli.Context) error {
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(conf.StatePath())
 	if err != nil {
 		return err
 	}
 
-	// If no commands are found, there's nothing else to do.
-	if appState == nil || len(appState.Commands) == 0 {
+	// If no name is provided, print the default environment and return.
+	if c.NArg() == 0 {
+		if appState.Default != "" {
+			fmt.Println(appState.Default)
+		}
 		return nil
 	}
-
-	// Otherwise, print a pretty table of all commands.
-	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
-	columnFmt := color.New(color.FgYellow).SprintfFunc()
-	tbl := table.New("Name", "Path", "Args", "Description")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
-	for name, command := range appState.Commands {
-		tbl.AddRow(name, command.BinPath, strings.Join(command.BinArgs, " "), command.Description)
-	}
-
-	tbl.Print()
-	return nil
-}
-
-// addCommand adds a new command to the state file.
-func addCommand(c *cli.Context) error {
-	// Verify correct usage.
-	if c.NArg() < 2 {
-		return errors.MinimumNumArgsError{Minimum: 2, Received: c.NArg()}
-	}
 	name := c.Args().Get(0)
-	command := c.Args().Tail()
-	description := c.String("description")
 
-	// Load the application state.
-	appState, err := state.Load(config.StatePath())
-	if err != nil {
+	// Set the default environment, ensuring it exists.
+	if err := appState.SetDefault(name); err != nil {
 		return err
 	}
 
 	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
+	if conf.DryRun {
 		return nil
 	}
 
-	// Add the command to the application state and save it back to the state file.
-	if err := appState.AddCommand(name, command, description); err != nil {
-		return err
-	}
-	if err := state.Save(appState, config.StatePath()); err != nil {
+	// Otherwise, save the application state back to the state file.
+	if err := state.Save(appState, conf.StatePath()); err != nil {
 		return err
 	}
 
 	// Success!
-	if config.Verbose {
-		fmt.Printf("added command: %s\n", name)
+	if conf.Verbose {
+		fmt.Printf("default environment set to: %s\n", name)
 	}
 	return nil
 }
 
-// removeCommand removes a command from the state file.
-func removeCommand(c *cli.Context) error {
+// showEnvironmentCommand prints the command line that opening an environment
+// would run, one argument per line unless joined, without launching it.
+func showEnvironmentCommand(c *cli.Context) error {
 	// Verify correct usage.
 	if c.NArg() != 1 {
 		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
@@ -441,114 +1532,243 @@ func removeCommand(c *cli.Context) error {
 	name := c.Args().Get(0)
 
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(appConfig(c).StatePath())
 	if err != nil {
 		return err
 	}
 
-	// Find the command in the application state.
-	if _, exists := appState.Commands[name]; !exists {
-		return errors.CommandNotFoundError{Name: name}
+	// Resolve the environment's command and config.
+	env, err := appState.Resolve(name)
+	if err != nil {
+		return err
 	}
 
-	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
+	cmdLine := env.CommandLine()
+	if c.Bool("join") {
+		fmt.Println(strings.Join(cmdLine, " "))
 		return nil
 	}
-
-	// Remove the command from the application state and save it back to the state file.
-	if err := appState.RemoveCommand(name); err != nil {
-		return err
-	}
-	if err := state.Save(appState, config.StatePath()); err != nil {
-		return err
-	}
-
-	// Success!
-	if config.Verbose {
-		fmt.Printf("removed command: %s\n", name)
+	for _, arg := range cmdLine {
+		fmt.Println(arg)
 	}
 	return nil
 }
 
-// listConfigs prints a table of all configuration directories in the state file.
-func listConfigs(_ *cli.Context) error {
-	// Load the application state.
-	appState, err := state.Load(config.StatePath())
-	if err != nil {
-		return err
-	}
-
-	// If no configuration directories are found, there's nothing else to do.
-	if appState == nil || len(appState.Configs) == 0 {
+// exactlyOneFlag ensures exactly one of two mutually exclusive flags is provided.
+func exactlyOneFlag(c *cli.Context, first, second string) error {
+	switch {
+	case c.String(first) != "" && c.String(second) != "":
+		return errors.ConflictingFlagsError{First: "--" + first, Second: "--" + second}
+	case c.String(first) == "" && c.String(second) == "":
+		return errors.MissingFlagError{First: "--" + first, Second: "--" + second}
+	default:
 		return nil
 	}
+}
 
-	// Otherwise, print a pretty table of all configuration directories.
-	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
-	columnFmt := color.New(color.FgYellow).SprintfFunc()
-	tbl := table.New("Name", "Path", "Description")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
-	for name, cfg := range appState.Configs {
-		tbl.AddRow(name, cfg.InitDir, cfg.Description)
+// atMostOneFlag ensures at most one of two mutually exclusive flags is provided.
+func atMostOneFlag(c *cli.Context, first, second string) error {
+	if c.String(first) != "" && c.String(second) != "" {
+		return errors.ConflictingFlagsError{First: "--" + first, Second: "--" + second}
 	}
-
-	tbl.Print()
 	return nil
 }
 
-// addConfig adds a new configuration to the state file.
-func addConfig(c *cli.Context) error {
+// stageEnvironment stages the addition of an environment to a transaction,
+// along with any command and config created inline from the flags. Git
+// repositories are not cloned in a dry run.
+func stageEnvironment(c *cli.Context, tx *state.Transaction, name string) error {
+	conf := appConfig(c)
+
+	description := c.String("description")
+	if description == "" {
+		description = "Not specified"
+	}
+	// Environments extending another inherit its description unless provided.
+	envDescription := description
+	if c.String("extends") != "" {
+		envDescription = c.String("description")
+	}
+
+	// Create the command inline from a command line, or use an existing one.
+	commandName := c.String("command")
+	commandLine, err := shellwords.Split(c.String("commandline"))
+	if err != nil {
+		return err
+	}
+	if len(commandLine) > 0 {
+		commandName = name
+		if err := tx.State.AddCommand(commandName, commandLine, nil, description); err != nil {
+			return err
+		}
+	}
+
+	// Create the config inline from a directory or git URL, or use an existing one.
+	configName := c.String("config")
+	if configDir := c.String("configdir"); configDir != "" {
+		configName = name
+		cfg := state.EmacsConfig{Description: description}
+		if !util.IsGitURL(configDir) {
+			if configDir, err = config.ExpandPath(configDir); err != nil {
+				return err
+			}
+		} else if conf.DryRun {
+			cfg.URL = configDir
+			printClone(conf, configName, configDir, 0)
+			configDir = conf.CachePath(configName)
+		} else {
+			cfg.URL = configDir
+			repoDir, err := cloneConfig(conf, configName, configDir, 0)
+			if err != nil {
+				return err
+			}
+			tx.OnRollback(func() error { return cache.RemoveRepo(conf.CachePath(), configName) })
+			configDir = repoDir
+		}
+		cfg.InitDir = configDir
+		if err := tx.State.AddConfig(configName, cfg); err != nil {
+			return err
+		}
+	}
+
+	// Add the environment using the command and config.
+	env, err := util.ParseKeyValues("env", c.StringSlice("env"))
+	if err != nil {
+		return err
+	}
+	workingDir, err := flagPath(c, "working-dir")
+	if err != nil {
+		return err
+	}
+	envFile, err := flagPath(c, "env-file")
+	if err != nil {
+		return err
+	}
+	return tx.State.AddEnvironment(name, state.Environment{
+		CommandName: commandName,
+		ConfigName:  configName,
+		Description: envDescription,
+		ExtraArgs:   c.StringSlice("arg"),
+		Env:         env,
+		WorkingDir:  workingDir,
+		EnvFile:     envFile,
+		PreHook:     c.String("pre"),
+		PostHook:    c.String("post"),
+		Title:       c.String("title"),
+		Extends:     c.String("extends"),
+	})
+}
+
+// flagPath returns the absolute path provided with a path flag, so that it is
+// found when opening emacs elsewhere, or an empty string if none is provided.
+func flagPath(c *cli.Context, name string) (string, error) {
+	path := c.String(name)
+	if path == "" {
+		return "", nil
+	}
+	path, err := config.ExpandPath(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// updateEnvironment updates an existing environment in the state file.
+func updateEnvironment(c *cli.Context) error {
+	conf := appConfig(c)
+
 	// Verify correct usage.
-	if c.NArg() != 2 {
-		return errors.UnexpectedNumArgsError{Expected: 2, Received: c.NArg()}
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
 	}
 	name := c.Args().Get(0)
-	path := c.Args().Get(1)
-	description := c.String("description")
 
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(conf.StatePath())
 	if err != nil {
 		return err
 	}
 
-	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
-		return nil
+	// Find the environment in the application state.
+	environment, exists := appState.Environments[name]
+	if !exists {
+		return errors.EnvironmentNotFoundError{Name: name}
 	}
 
-	// If the path is a git URL, add the repository to the cache.
-	if util.IsGitURL(path) {
-		// Add the repository to the cache.
-		url := path
-		cacheDir := config.CachePath()
-		if err := util.EnsureDir(cacheDir); err != nil {
+	// Update the environment with the provided flags and validate it.
+	if c.IsSet("command") {
+		environment.CommandName = c.String("command")
+	}
+	if c.IsSet("config") {
+		environment.ConfigName = c.String("config")
+	}
+	if c.IsSet("description") {
+		environment.Description = c.String("description")
+	}
+	if c.IsSet("arg") {
+		environment.ExtraArgs = c.StringSlice("arg")
+	}
+	if c.IsSet("env") {
+		if environment.Env, err = util.ParseKeyValues("env", c.StringSlice("env")); err != nil {
 			return err
 		}
-		if path, err = cache.AddRepo(cacheDir, name, url); err != nil {
+	}
+	if c.IsSet("working-dir") {
+		if environment.WorkingDir, err = flagPath(c, "working-dir"); err != nil {
 			return err
 		}
 	}
-
-	// Otherwise, add the configuration to the application state and save it back to the state file.
-	if err := appState.AddConfig(name, path, description); err != nil {
+	if c.IsSet("env-file") {
+		if environment.EnvFile, err = flagPath(c, "env-file"); err != nil {
+			return err
+		}
+	}
+	if c.IsSet("pre") {
+		environment.PreHook = c.String("pre")
+	}
+	if c.IsSet("post") {
+		environment.PostHook = c.String("post")
+	}
+	if c.IsSet("title") {
+		environment.Title = c.String("title")
+	}
+	if c.IsSet("extends") {
+		environment.Extends = c.String("extends")
+	}
+	if err := appState.UpdateEnvironment(name, environment); err != nil {
 		return err
 	}
-	if err := state.Save(appState, config.StatePath()); err != nil {
+
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Otherwise, save the updated environment back to the state file.
+	if err := state.Save(appState, conf.StatePath()); err != nil {
 		return err
 	}
 
 	// Success!
-	if config.Verbose {
-		fmt.Printf("added configuration: %s\n", name)
+	if conf.Verbose {
+		fmt.Printf("updated environment: %s\n", name)
 	}
 	return nil
+}
 
+// rollback rolls back a transaction after an error, returning the error along
+// with any errors reported while rolling back.
+func rollback(tx *state.Transaction, err error) error {
+	if rollbackErr := tx.Rollback(); rollbackErr != nil {
+		return fmt.Errorf("%w (rollback failed: %s)", err, rollbackErr)
+	}
+	return err
 }
 
-// removeConfig removes a configuration from the state file.
-func removeConfig(c *cli.Context) error {
+// removeEnvironment removes an environment from the state file.
+func removeEnvironment(c *cli.Context) error {
+	conf := appConfig(c)
+
 	// Verify correct usage.
 	if c.NArg() != 1 {
 		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
@@ -556,181 +1776,2922 @@ func removeConfig(c *cli.Context) error {
 	name := c.Args().Get(0)
 
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(conf.StatePath())
 	if err != nil {
 		return err
 	}
 
-	// Find the config in the application state.
-	if _, exists := appState.Configs[name]; !exists {
-		return errors.ConfigNotFoundError{Name: name}
+	// Find the environment in the application state, with its inherited settings.
+	environment, exists := appState.Environments[name]
+	if !exists {
+		return errors.EnvironmentNotFoundError{Name: name}
+	}
+	if effective, err := appState.Effective(name); err == nil {
+		environment = effective
+	}
+
+	// Ensure no environment still extends the environment unless requested.
+	if references := appState.EnvironmentReferences(name); len(references) > 0 && !c.Bool("dangling") {
+		return errors.EnvironmentInUseError{Name: name, Environments: references}
+	}
+
+	// Ensure the active context is not cleared unless forced, switching it to
+	// the only other environment instead if there is one.
+	var nextContext string
+	if appState.Context == name {
+		for other := range appState.Environments {
+			if other != name && len(appState.Environments) == 2 {
+				nextContext = other
+			}
+		}
+		if nextContext == "" && !c.Bool("force") {
+			return errors.ActiveContextError{Name: name}
+		}
+	}
+
+	// If cascading, find the command and config no other environment uses.
+	removals := []string{"environment " + name}
+	var commandName, configName string
+	if c.Bool("cascade") {
+		if slices.Equal(appState.CommandReferences(environment.CommandName), []string{name}) {
+			commandName = environment.CommandName
+			removals = append(removals, "command "+commandName)
+		}
+		if slices.Equal(appState.ConfigReferences(environment.ConfigName), []string{name}) {
+			configName = environment.ConfigName
+			removals = append(removals, "configuration "+configName)
+		}
 	}
 
 	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
+	if conf.DryRun {
 		return nil
 	}
 
-	// Otherwise, remove any cached repository from the filesystem.
-	cacheDir := config.CachePath()
-	if cache.IsCached(cacheDir, name) {
-		if err := cache.RemoveRepo(cacheDir, name); err != nil {
-			return err
-		}
+	// Otherwise, ensure the removal is intended.
+	if !confirmRemoval(c, fmt.Sprintf("Remove %s?", strings.Join(removals, ", "))) {
+		return errors.AbortedError
 	}
 
-	// Remove config from the application state and save it back to the state file.
-	if err := appState.RemoveConfig(name); err != nil {
+	// Remove the environment, along with any command and config only it used,
+	// from the application state and save it back to the state file.
+	hadContext := appState.Context != ""
+	if err := appState.RemoveEnvironment(name); err != nil {
 		return err
 	}
-	if err := state.Save(appState, config.StatePath()); err != nil {
+	if nextContext != "" {
+		if err := appState.SetContext(nextContext); err != nil {
+			return err
+		}
+	}
+	if commandName != "" {
+		if err := appState.RemoveCommand(commandName); err != nil {
+			return err
+		}
+	}
+	cfg := appState.Configs[configName]
+	if configName != "" {
+		if err := appState.RemoveConfig(configName); err != nil {
+			return err
+		}
+	}
+	if err := state.Save(appState, conf.StatePath()); err != nil {
 		return err
 	}
 
+	// Remove any cached repositories of a removed config from the filesystem.
+	if configName != "" {
+		if err := removeConfigFiles(conf, configName, cfg); err != nil {
+			return err
+		}
+	}
+
 	// Success!
-	if config.Verbose {
-		fmt.Printf("removed configuration: %s\n", name)
+	if conf.Verbose {
+		for _, removal := range removals {
+			fmt.Printf("removed %s\n", removal)
+		}
+	}
+	if !conf.Quiet {
+		switch {
+		case nextContext != "":
+			fmt.Printf("switched context to %s\n", nextContext)
+		case hadContext && appState.Context == "":
+			fmt.Println("cleared context")
+		}
 	}
 	return nil
 }
 
-// showState prints the application state.
-func showState(_ *cli.Context) error {
-	// Load the application state and print it to stdout.
-	appState, err := state.Load(config.StatePath())
+// listCommands prints a table of all commands in the state file.
+func listCommands(c *cli.Context) error {
+	// Load the application state.
+	appState, err := loadState(appConfig(c).StatePath())
 	if err != nil {
 		return err
 	}
 
-	data, err := json.MarshalIndent(appState, "", "  ")
+	// If no commands are found, there's nothing else to do.
+	if appState == nil || len(appState.Commands) == 0 {
+		return nil
+	}
+
+	// Otherwise, print all commands in the desired output format.
+	rows := make([][]string, 0, len(appState.Commands))
+	for name, command := range appState.Commands {
+		row := []string{name, command.BinPath, strings.Join(command.BinArgs, " "), command.Description}
+		if c.Bool("usage") {
+			row = append(row, strings.Join(appState.CommandReferences(name), render.ListSeparator))
+		}
+		if withTimestamps(c) {
+			row = append(row, command.CreatedAt, command.UpdatedAt)
+		}
+		rows = append(rows, row)
+	}
+	headers := []string{"Name", "Path", "Args", "Description"}
+	if c.Bool("usage") {
+		headers = append(headers, render.UsedBy)
+	}
+	if withTimestamps(c) {
+		headers = append(headers, timestampHeaders...)
+	}
+	if err := sortRows(rows, headers, c.String("sort")); err != nil {
+		return err
+	}
+	return renderEntityRows(c, headers, rows, appState.Commands)
+}
+
+// addCommand adds a new command to the state file.
+func addCommand(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	detect := c.Bool("detect-emacs")
+	shell := c.String("shell")
+	if detect && shell != "" {
+		return errors.ConflictingFlagsError{First: "--shell", Second: "--detect-emacs"}
+	}
+	if c.IsSet("from") {
+		return addCommandFrom(c)
+	}
+	if c.IsSet("arg") {
+		return errors.RequiresFlagError{Flag: "--arg", Required: "--from"}
+	}
+	if (detect || shell != "") && c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	if !detect && shell == "" && c.NArg() < 2 {
+		return errors.MinimumNumArgsError{Minimum: 2, Received: c.NArg()}
+	}
+	name := c.Args().Get(0)
+	command := c.Args().Tail()
+	description := c.String("description")
+	client, err := shellwords.Split(c.String("client"))
 	if err != nil {
 		return err
 	}
 
-	_, err = os.Stdout.Write(data)
-	return err
-}
+	// If provided, split the shell command line into the command line.
+	if shell != "" {
+		if command, err = shellwords.Split(shell); err != nil {
+			return err
+		}
+		if len(command) == 0 {
+			return errors.InvalidCommandLineError{CommandLine: shell, Reason: "no command"}
+		}
+	}
 
-// showStatePath prints the path of the application state file.
-func showStatePath(_ *cli.Context) error {
-	fmt.Println(config.StatePath())
-	return nil
-}
+	// If requested, detect the emacs binary to use for the command line.
+	if detect {
+		binPath, err := detectEmacs(c)
+		if err != nil {
+			return err
+		}
+		command = []string{binPath}
+	}
+	version := verifyEmacs(c, command[0])
 
-// getContext prints the active configuration context in the state file.
-func getContext(_ *cli.Context) error {
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(conf.StatePath())
 	if err != nil {
 		return err
 	}
 
-	// Print the active context.
-	fmt.Println(appState.Context)
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Add the command to the application state and save it back to the state file.
+	if err := appState.AddCommand(name, command, client, description); err != nil {
+		return err
+	}
+	if version != "" {
+		added := appState.Commands[name]
+		added.Version = version
+		appState.Commands[name] = added
+	}
+	if err := state.Save(appState, conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("added command: %s\n", name)
+	}
 	return nil
 }
 
-// setContext gets or sets the active configuration context in the state file.
-func setContext(c *cli.Context) error {
+// addCommandFrom adds a new command to the state file copying the command line
+// of an existing command, with any extra arguments appended.
+func addCommandFrom(c *cli.Context) error {
+	conf := appConfig(c)
+
 	// Verify correct usage.
+	for _, flag := range []string{"shell", "detect-emacs", "client"} {
+		if c.IsSet(flag) {
+			return errors.ConflictingFlagsError{First: "--from", Second: "--" + flag}
+		}
+	}
 	if c.NArg() != 1 {
 		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
 	}
+	name := c.Args().Get(0)
 
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(conf.StatePath())
 	if err != nil {
 		return err
 	}
 
 	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
+	if conf.DryRun {
 		return nil
 	}
 
-	// Otherwise, set the active context and save it back to the state file.
-	appState.Context = c.Args().Get(0)
-	return state.Save(appState, config.StatePath())
+	// Add the command to the application state and save it back to the state file.
+	if err := appState.AddCommandFrom(name, c.String("from"), c.StringSlice("arg"), c.String("description")); err != nil {
+		return err
+	}
+	if err := state.Save(appState, conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("added command: %s\n", name)
+	}
+	return nil
 }
 
-// clearContext clears the active configuration context in the state file.
-func clearContext(_ *cli.Context) error {
+// verifyEmacs returns the version of an emacs binary, warning if it cannot be
+// found, unless verification is skipped with the --no-verify flag.
+func verifyEmacs(c *cli.Context, binPath string) string {
+	if c.Bool("no-verify") {
+		return ""
+	}
+	path, err := exec.LookPath(binPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: emacs binary not found: %s\n", binPath)
+		return ""
+	}
+	if version := util.EmacsVersion(runWith(appRunner(c)), path); version != "unknown" {
+		return version
+	}
+	return ""
+}
+
+// commandTestTimeout is the maximum duration of running a command with --version.
+const commandTestTimeout = 10 * time.Second
+
+// testCommand verifies that a command in the state file launches by running
+// its command line with --version, printing the version it reports.
+func testCommand(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	name := c.Args().Get(0)
+
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(conf.StatePath())
 	if err != nil {
 		return err
 	}
 
-	// If is a dry run, there's nothing else to do.
-	if config.DryRun {
+	// Find the command in the application state.
+	command, exists := appState.Commands[name]
+	if !exists {
+		return errors.CommandNotFoundError{Name: name}
+	}
+	cmdLine := append([]string{command.BinPath}, command.BinArgs...)
+	cmdLine = append(cmdLine, "--version")
+
+	// If is a dry run, print the command line that would be run and return.
+	if conf.DryRun {
+		fmt.Println(strings.Join(cmdLine, " "))
 		return nil
 	}
 
-	// Otherwise, clear the active context and save it back to the state file.
-	appState.Context = ""
-	return state.Save(appState, config.StatePath())
+	// Otherwise, run the command line, giving up if it does not exit in time.
+	ctx, cancel := context.WithTimeout(context.Background(), commandTestTimeout)
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
+	cmd.Stdout = &stdout
+	cmd.WaitDelay = time.Second
+	if err := runCommand(appRunner(c), cmd); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", commandTestTimeout)
+		}
+		return errors.CommandTestError{Name: name, Err: err}
+	}
+
+	// Success!
+	if !conf.Quiet {
+		version, _, _ := strings.Cut(stdout.String(), "\n")
+		fmt.Printf("%s: ok: %s\n", name, valueOrNone(strings.TrimSpace(version)))
+	}
+	return nil
 }
 
-// openEmacs opens emacs with the desired configuration and all provided arguments.
-func openEmacs(_ *cli.Context) error {
+// placeholderInitDir is the init directory used to render command lines when no configuration is provided.
+const placeholderInitDir = "<INIT_DIR>"
+
+// showCommand prints the details of a command in the state file.
+func showCommand(c *cli.Context) error {
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	name := c.Args().Get(0)
+
 	// Load the application state.
-	appState, err := state.Load(config.StatePath())
+	appState, err := loadState(appConfig(c).StatePath())
 	if err != nil {
 		return err
 	}
 
-	// Ensure an active context is set.
-	context := config.Context
-	if context == "" {
-		context = appState.Context
-	}
-	if context == "" {
-		return errors.NoContextError
+	// Find the command in the application state.
+	command, exists := appState.Commands[name]
+	if !exists {
+		return errors.CommandNotFoundError{Name: name}
 	}
 
-	// Get the environment.
-	env, ok := appState.Environments[context]
-	if !ok {
-		return errors.EnvironmentNotFoundError{Name: context}
+	// Find the init directory to render the command line with.
+	initDir := placeholderInitDir
+	if configName := c.String("config"); configName != "" {
+		cfg, exists := appState.Configs[configName]
+		if !exists {
+			return errors.ConfigNotFoundError{Name: configName}
+		}
+		initDir = cfg.InitDir
 	}
 
-	// Get the command to use.
-	cmd, ok := appState.Commands[env.CommandName]
-	if !ok {
-		return errors.CommandNotFoundError{Name: env.CommandName}
+	// Print the details in the requested format.
+	switch output := c.String("output"); output {
+	case "json":
+		return printJSON(command)
+	case "text":
+		fmt.Printf("name:         %s\n", name)
+		fmt.Printf("description:  %s\n", command.Description)
+		fmt.Printf("bin path:     %s\n", command.BinPath)
+		fmt.Printf("bin args:     %q\n", command.BinArgs)
+		fmt.Printf("version:      %s\n", valueOrNone(command.Version))
+		fmt.Printf("command line: %s\n", strings.Join(command.CommandLine(initDir), " "))
+		return nil
+	default:
+		return errors.InvalidValueError{Name: "output", Value: output}
 	}
+}
 
-	// Get the config to use.
-	cfg, ok := appState.Configs[env.ConfigName]
-	if !ok {
-		return errors.ConfigNotFoundError{Name: env.ConfigName}
+// detectEmacs detects installed emacs binaries and returns the path of the one
+// chosen by the user, or of the first one found when not interactive.
+func detectEmacs(c *cli.Context) (string, error) {
+	conf := appConfig(c)
+	installs := util.DetectEmacsBinaries(runWith(appRunner(c)))
+	if len(installs) == 0 {
+		return "", errors.NoEmacsFoundError
 	}
 
-	// Build the command line to execute.
-	cmdLine := cmd.CommandLine(cfg.InitDir)
-
-	// If is a dry run, print the command line and return.
-	if config.DryRun {
-		fmt.Println(strings.Join(cmdLine, " "))
-		return nil
+	options := make([]string, len(installs))
+	for i, install := range installs {
+		options[i] = fmt.Sprintf("%s (%s)", install.Path, install.Version)
+	}
+	if len(installs) == 1 || !util.IsInteractive() {
+		if conf.Verbose {
+			fmt.Printf("detected emacs: %s\n", options[0])
+		}
+		return installs[0].Path, nil
 	}
 
-	// Otherwise, execute the command.
-	return exec.Command(cmdLine[0], cmdLine[1:]...).Run()
+	choice, err := util.Choose("Choose an emacs binary", options)
+	if err != nil {
+		return "", err
+	}
+	return installs[choice].Path, nil
 }
 
-// showAppVersion prints the version of the application set at build time by
-// the `go build -ldflags "-X github.com/mojochao/emacsctl/app.version=0.10.0" -o emacsctl .` command.
-var version string
+// removeCommand removes a command from the state file.
+func removeCommand(c *cli.Context) error {
+	conf := appConfig(c)
 
-// showAppVersion prints the version of the application.
-func showAppVersion(_ *cli.Context) error {
-	fmt.Printf("emacsctl version %s\n", version)
-	if !config.Verbose {
-		return nil
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
 	}
+	name := c.Args().Get(0)
 
-	buildInfo := util.GetBuildInfo()
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the command in the application state.
+	if _, exists := appState.Commands[name]; !exists {
+		return errors.CommandNotFoundError{Name: name}
+	}
+
+	// Ensure no environment still uses the command unless forced.
+	if references := appState.CommandReferences(name); len(references) > 0 && !c.Bool("force") {
+		return errors.CommandInUseError{Name: name, Environments: references}
+	}
+
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Otherwise, ensure the removal is intended.
+	if !confirmRemoval(c, fmt.Sprintf("Remove command %s?", name)) {
+		return errors.AbortedError
+	}
+
+	// Remove the command from the application state and save it back to the state file.
+	if err := appState.RemoveCommand(name); err != nil {
+		return err
+	}
+	if err := state.Save(appState, conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("removed command: %s\n", name)
+	}
+	return nil
+}
+
+// listConfigs prints a table of all configuration directories in the state file.
+func listConfigs(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// If no configuration directories are found, there's nothing else to do.
+	if appState == nil || len(appState.Configs) == 0 {
+		return nil
+	}
+
+	// If requested, print configuration directories sorted by cache size instead.
+	if c.Bool("sort-by-size") {
+		return listConfigsBySize(c, appState)
+	}
+
+	// Otherwise, print all configuration directories in the desired output format.
+	rows := make([][]string, 0, len(appState.Configs))
+	for name, cfg := range appState.Configs {
+		row := []string{name, cfg.InitDir, configStatus(conf, cfg), cfg.Description}
+		if c.Bool("usage") {
+			row = append(row, strings.Join(appState.ConfigReferences(name), render.ListSeparator))
+		}
+		if withTimestamps(c) {
+			row = append(row, cfg.CreatedAt, cfg.UpdatedAt)
+		}
+		rows = append(rows, row)
+	}
+	headers := []string{"Name", "Path", "Status", "Description"}
+	if c.Bool("usage") {
+		headers = append(headers, render.UsedBy)
+	}
+	if withTimestamps(c) {
+		headers = append(headers, timestampHeaders...)
+	}
+	if err := sortRows(rows, headers, c.String("sort")); err != nil {
+		return err
+	}
+	if c.String("output") == render.Table && c.String("format") == "" {
+		for _, row := range rows {
+			row[2] = colorConfigStatus(row[2])
+		}
+	}
+	return renderEntityRows(c, headers, rows, appState.Configs)
+}
+
+// Statuses of configuration directories reported by configStatus.
+const (
+	configStatusLocal     = "local"
+	configStatusCached    = "cached"
+	configStatusUnfetched = "unfetched"
+	configStatusMissing   = "missing"
+)
+
+// configStatus returns whether a configuration's init directory is missing
+// from disk, and if so whether config fetch would clone it, or else whether
+// it is managed in the cache or local to the user.
+func configStatus(conf *config.Config, cfg state.EmacsConfig) string {
+	if info, err := os.Stat(cfg.InitDir); err != nil || !info.IsDir() {
+		if cfg.URL != "" || slices.ContainsFunc(cfg.Sources, util.IsGitURL) {
+			return configStatusUnfetched
+		}
+		return configStatusMissing
+	}
+	parent := filepath.Dir(cfg.InitDir)
+	if parent == conf.CachePath() || parent == conf.ComposedPath() {
+		return configStatusCached
+	}
+	return configStatusLocal
+}
+
+// checkFetched returns an error describing how to fix a git-backed
+// configuration whose repositories are not cloned into the cache yet.
+func checkFetched(conf *config.Config, name string, cfg state.EmacsConfig) error {
+	if cfg.URL == "" && len(cfg.Sources) == 0 {
+		return nil
+	}
+	if !isFetched(conf, name, cfg) {
+		return errors.ConfigNotFetchedError{Name: name}
+	}
+	return nil
+}
+
+// isFetched checks if the cached repositories backing a configuration are all
+// cloned into the cache.
+func isFetched(conf *config.Config, name string, cfg state.EmacsConfig) bool {
+	for _, repoName := range configRepoNames(name, cfg) {
+		if !cache.IsCached(conf.CachePath(), repoName) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkInitDir returns an error describing how to fix a configuration whose
+// init directory is missing from disk.
+func checkInitDir(conf *config.Config, name string, cfg state.EmacsConfig) error {
+	if configStatus(conf, cfg) == configStatusMissing {
+		return errors.InitDirNotFoundError{Config: name, Path: cfg.InitDir}
+	}
+	return nil
+}
+
+// colorConfigStatus colors a configuration status for display in a table,
+// green when local, yellow when cached, and red when unfetched or missing.
+func colorConfigStatus(status string) string {
+	switch status {
+	case configStatusLocal:
+		return color.GreenString(status)
+	case configStatusCached:
+		return color.YellowString(status)
+	default:
+		return color.RedString(status)
+	}
+}
+
+// listConfigsBySize prints all configuration directories sorted by the size of
+// their cached repository, largest first, with configurations that are not
+// cached last.
+func listConfigsBySize(c *cli.Context, appState *state.State) error {
+	type sizedConfig struct {
+		name string
+		cfg  state.EmacsConfig
+		size int64
+	}
+
+	// Compute the size of each cached configuration, using -1 for those not cached.
+	cacheDir := appConfig(c).CachePath()
+	configs := make([]sizedConfig, 0, len(appState.Configs))
+	for name, cfg := range appState.Configs {
+		size := int64(-1)
+		if cache.IsCached(cacheDir, name) {
+			var err error
+			if size, err = cache.RepoSize(cacheDir, name); err != nil {
+				return err
+			}
+		}
+		configs = append(configs, sizedConfig{name: name, cfg: cfg, size: size})
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		if configs[i].size != configs[j].size {
+			return configs[i].size > configs[j].size
+		}
+		return configs[i].name < configs[j].name
+	})
+
+	// Print them in the desired output format.
+	rows := make([][]string, 0, len(configs))
+	for _, sized := range configs {
+		size := "N/A"
+		if sized.size >= 0 {
+			size = util.FormatSize(sized.size)
+		}
+		row := []string{sized.name, sized.cfg.InitDir, size, sized.cfg.Description}
+		if c.Bool("usage") {
+			row = append(row, strings.Join(appState.ConfigReferences(sized.name), render.ListSeparator))
+		}
+		if withTimestamps(c) {
+			row = append(row, sized.cfg.CreatedAt, sized.cfg.UpdatedAt)
+		}
+		rows = append(rows, row)
+	}
+	headers := []string{"Name", "Path", "Size", "Description"}
+	if c.Bool("usage") {
+		headers = append(headers, render.UsedBy)
+	}
+	if withTimestamps(c) {
+		headers = append(headers, timestampHeaders...)
+	}
+	return renderEntityRows(c, headers, rows, appState.Configs)
+}
+
+// addConfig adds a new configuration to the state file.
+func addConfig(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	sources := c.StringSlice("source")
+	templateName := c.String("template")
+	if templateName != "" && len(sources) > 0 {
+		return errors.ConflictingFlagsError{First: "--template", Second: "--source"}
+	}
+	if templateName != "" || len(sources) > 0 {
+		if c.NArg() != 1 {
+			return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+		}
+	} else if c.NArg() != 2 {
+		return errors.UnexpectedNumArgsError{Expected: 2, Received: c.NArg()}
+	}
+	if len(sources) == 1 {
+		return errors.InvalidValueError{Name: "source", Value: "at least two sources are required"}
+	}
+	name := c.Args().Get(0)
+	path := c.Args().Get(1)
+	if templateName != "" {
+		url, err := templates.URL(templateName)
+		if err != nil {
+			return err
+		}
+		path = url
+	}
+	description := c.String("description")
+	postCheckout, err := shellwords.Split(c.String("post-checkout"))
+	if err != nil {
+		return err
+	}
+	depth := c.Int("depth")
+	noCache := c.Bool("no-cache")
+	if noCache && !util.IsGitURL(path) && !slices.ContainsFunc(sources, util.IsGitURL) {
+		return errors.ConfigNotGitBackedError{Name: name}
+	}
+
+	// Load the application state, ensuring the configuration does not exist
+	// before cloning anything for it.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+	if appState.ConfigExists(name) {
+		return errors.ConfigExistsError{Name: name}
+	}
+
+	// If is a dry run, print the clones that would be run and return.
+	if conf.DryRun {
+		for i, source := range sources {
+			if util.IsGitURL(source) && !noCache {
+				printClone(conf, sourceRepoName(name, i), source, depth)
+			}
+		}
+		if len(sources) == 0 && util.IsGitURL(path) && !noCache {
+			printClone(conf, name, path, depth)
+		}
+		return nil
+	}
+
+	// Otherwise, add the configuration in a transaction, so that a failure
+	// after cloning leaves no cloned or composed directories behind.
+	tx := appState.Begin()
+
+	// If composed from sources, add the git repositories among them to the
+	// cache and compose them in the application directory, unless leaving the
+	// clones to config fetch.
+	var cfgSources []string
+	var url string
+	if len(sources) > 0 {
+		for i, source := range sources {
+			if util.IsGitURL(source) && noCache {
+				cfgSources = append(cfgSources, source)
+				continue
+			}
+			if util.IsGitURL(source) {
+				repoName := sourceRepoName(name, i)
+				dir, err := cloneConfig(conf, repoName, source, depth)
+				if err != nil {
+					return rollback(tx, err)
+				}
+				tx.OnRollback(func() error { return cache.RemoveRepo(conf.CachePath(), repoName) })
+				if err := runPostCheckout(c, dir, postCheckout); err != nil {
+					return rollback(tx, err)
+				}
+				cfgSources = append(cfgSources, source)
+				continue
+			}
+			dir, err := config.ExpandPath(source)
+			if err != nil {
+				return rollback(tx, err)
+			}
+			if dir, err = filepath.Abs(dir); err != nil {
+				return rollback(tx, err)
+			}
+			cfgSources = append(cfgSources, dir)
+		}
+		path = conf.ComposedPath(name)
+	} else if util.IsGitURL(path) {
+		// If the path is a git URL, add the repository to the cache, or just
+		// record where it will be when leaving the clone to config fetch.
+		url = path
+		if noCache {
+			path = conf.CachePath(name)
+		} else {
+			if path, err = cloneConfig(conf, name, path, depth); err != nil {
+				return rollback(tx, err)
+			}
+			tx.OnRollback(func() error { return cache.RemoveRepo(conf.CachePath(), name) })
+			if err := runPostCheckout(c, path, postCheckout); err != nil {
+				return rollback(tx, err)
+			}
+		}
+	}
+
+	// Add the configuration to the application state and save it back to the state file.
+	cfg := state.EmacsConfig{
+		InitDir:      path,
+		Description:  description,
+		PostCheckout: postCheckout,
+		Depth:        depth,
+		Sources:      cfgSources,
+		URL:          url,
+	}
+	if err := tx.State.AddConfig(name, cfg); err != nil {
+		return rollback(tx, err)
+	}
+	if !noCache && len(cfgSources) > 0 {
+		tx.OnRollback(func() error { return os.RemoveAll(conf.ComposedPath(name)) })
+		if err := composeConfig(conf, name, cfg); err != nil {
+			return rollback(tx, err)
+		}
+	}
+	if err := state.Save(tx.State, conf.StatePath()); err != nil {
+		return rollback(tx, err)
+	}
+	tx.Commit()
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("added configuration: %s\n", name)
+	}
+	return nil
+}
+
+// runPostCheckout runs the post-checkout command of a configuration in a
+// freshly cloned repository, but only if it is explicitly trusted.
+func runPostCheckout(c *cli.Context, repoDir string, postCheckout []string) error {
+	if len(postCheckout) == 0 {
+		return nil
+	}
+	if !c.Bool("trust") {
+		fmt.Fprintf(os.Stderr, "not running untrusted post-checkout command, use --trust to run it: %s\n", strings.Join(postCheckout, " "))
+		return nil
+	}
+	return cache.RunHook(repoDir, postCheckout)
+}
+
+// sourceRepoName returns the name of the cached repository of the git source
+// at an index of a configuration composed from sources.
+func sourceRepoName(name string, index int) string {
+	return fmt.Sprintf("%s.%d", name, index+1)
+}
+
+// configRepoNames returns the names of the cached repositories backing a
+// configuration, which are those of its git sources if composed from sources.
+func configRepoNames(name string, cfg state.EmacsConfig) []string {
+	if len(cfg.Sources) == 0 {
+		return []string{name}
+	}
+	var names []string
+	for i, source := range cfg.Sources {
+		if util.IsGitURL(source) {
+			names = append(names, sourceRepoName(name, i))
+		}
+	}
+	return names
+}
+
+// composeConfig links the files of the sources of a configuration composed
+// from sources into its directory, doing nothing for other configurations.
+func composeConfig(conf *config.Config, name string, cfg state.EmacsConfig) error {
+	if len(cfg.Sources) == 0 {
+		return nil
+	}
+	dirs := make([]string, len(cfg.Sources))
+	for i, source := range cfg.Sources {
+		dirs[i] = source
+		if util.IsGitURL(source) {
+			dirs[i] = conf.CachePath(sourceRepoName(name, i))
+		}
+	}
+	return cache.Compose(conf.ComposedPath(name), dirs)
+}
+
+// showConfigPath prints the absolute init directory of a configuration, which
+// is its cache directory for git-backed configurations.
+func showConfigPath(c *cli.Context) error {
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	name := c.Args().Get(0)
+
+	// Load the application state.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the config in the application state.
+	cfg, exists := appState.Configs[name]
+	if !exists {
+		return errors.ConfigNotFoundError{Name: name}
+	}
+
+	path, err := filepath.Abs(cfg.InitDir)
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+// openConfig opens the directory of a configuration in the emacs of an
+// environment, to edit the configuration with emacs itself.
+func openConfig(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	if c.String("env") != "" && c.String("context") != "" {
+		return errors.ConflictingFlagsError{First: "--env", Second: "--context"}
+	}
+	name := c.Args().Get(0)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the config in the application state.
+	cfg, exists := appState.Configs[name]
+	if !exists {
+		return errors.ConfigNotFoundError{Name: name}
+	}
+	dir, err := filepath.Abs(cfg.InitDir)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the environment to edit with, falling back to the environment context.
+	context := c.String("env")
+	if context == "" {
+		if context, err = resolveContext(c, appState); err != nil {
+			return err
+		}
+	}
+	env, err := appState.Resolve(context)
+	if err != nil {
+		return err
+	}
+	cmdLine := append(env.CommandLine(), dir)
+	environ, err := env.Environment.Environ()
+	if err != nil {
+		return err
+	}
+	opts := launchOptions{
+		environ: environ,
+		dir:     env.Environment.WorkingDir,
+		runner:  appRunner(c),
+	}
+
+	// If is a dry run, print the command line and return.
+	if conf.DryRun {
+		opts.printDir()
+		opts.printEnviron()
+		fmt.Println(strings.Join(cmdLine, " "))
+		return nil
+	}
+
+	// Otherwise, compose the configurations if needed, ensure they exist rather
+	// than letting emacs fail confusingly, and execute the command.
+	if err := checkFetched(conf, env.Environment.ConfigName, env.Config); err != nil {
+		return err
+	}
+	if err := checkFetched(conf, name, cfg); err != nil {
+		return err
+	}
+	if err := composeConfig(conf, env.Environment.ConfigName, env.Config); err != nil {
+		return err
+	}
+	if err := composeConfig(conf, name, cfg); err != nil {
+		return err
+	}
+	if err := checkInitDir(conf, env.Environment.ConfigName, env.Config); err != nil {
+		return err
+	}
+	if err := checkInitDir(conf, name, cfg); err != nil {
+		return err
+	}
+	return runCommandLine(cmdLine, opts)
+}
+
+// showConfigStatus prints a table of how far git-backed configurations are
+// ahead of or behind their remotes. Errors for a configuration are reported in
+// its status rather than aborting the others.
+func showConfigStatus(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Determine the configs to report on, defaulting to all of them.
+	names := c.Args().Slice()
+	if len(names) == 0 {
+		for name := range appState.Configs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	// Report the status of each config in the desired output format.
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		cfg, exists := appState.Configs[name]
+		if !exists {
+			rows = append(rows, []string{name, "error: " + errors.ConfigNotFoundError{Name: name}.Error(), "", ""})
+			continue
+		}
+		if !isGitBacked(conf, cfg) {
+			rows = append(rows, []string{name, configStatusLocal, "", ""})
+			continue
+		}
+		rows = append(rows, repoStatusRow(c, name, cfg))
+	}
+	return renderRows(c, []string{"Name", "Status", "Ahead", "Behind"}, rows)
+}
+
+// repoStatusRow returns the config status row of a git-backed configuration,
+// adding up how far its cached repositories are ahead and behind their remotes.
+func repoStatusRow(c *cli.Context, name string, cfg state.EmacsConfig) []string {
+	conf := appConfig(c)
+	cacheDir := conf.CachePath()
+	var ahead, behind int
+	for _, repoName := range configRepoNames(name, cfg) {
+		if !cache.IsCached(cacheDir, repoName) {
+			return []string{name, configStatusUnfetched, "", ""}
+		}
+		if !c.Bool("offline") {
+			ctx, cancel := gitContext(conf)
+			err := cache.FetchRepo(ctx, cacheDir, repoName)
+			cancel()
+			if err != nil {
+				return []string{name, "error: fetch failed: " + err.Error(), "", ""}
+			}
+		}
+		ctx, cancel := gitContext(conf)
+		repoAhead, repoBehind, err := cache.AheadBehind(ctx, cacheDir, repoName)
+		cancel()
+		if err != nil {
+			return []string{name, "error: " + err.Error(), "", ""}
+		}
+		ahead += repoAhead
+		behind += repoBehind
+	}
+	status := "up to date"
+	if behind > 0 {
+		status = "behind"
+	} else if ahead > 0 {
+		status = "ahead"
+	}
+	return []string{name, status, strconv.Itoa(ahead), strconv.Itoa(behind)}
+}
+
+// cloneConfig clones the git repository of a configuration into the cache and
+// returns its location in it. If depth is positive, the clone is shallow.
+func cloneConfig(conf *config.Config, name, url string, depth int) (string, error) {
+	cacheDir := conf.CachePath()
+	if err := util.EnsureDir(cacheDir); err != nil {
+		return "", err
+	}
+	ctx, cancel := gitContext(conf)
+	defer cancel()
+	return cache.AddRepo(ctx, cacheDir, name, url, depth)
+}
+
+// printClone prints the git command line cloning the repository of a
+// configuration into the cache, in place of cloning it on a dry run.
+func printClone(conf *config.Config, repoName, url string, depth int) {
+	fmt.Println(strings.Join(cache.CloneCommandLine(conf.CachePath(), repoName, url, depth), " "))
+}
+
+// gitContext returns a context limiting a git operation to the duration
+// provided by the --timeout flag.
+func gitContext(conf *config.Config) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), conf.GitTimeout)
+}
+
+// updateConfig pulls the latest changes into a git-backed configuration and
+// runs its post-checkout command, if any.
+func updateConfig(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	name := c.Args().Get(0)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the config in the application state and ensure it is cached.
+	cfg, exists := appState.Configs[name]
+	if !exists {
+		return errors.ConfigNotFoundError{Name: name}
+	}
+	cacheDir := conf.CachePath()
+	repoNames := configRepoNames(name, cfg)
+	for _, repoName := range repoNames {
+		if !cache.IsCached(cacheDir, repoName) {
+			return errors.ConfigNotCachedError{Name: repoName}
+		}
+	}
+
+	// If is a dry run, print the pulls that would be run and return.
+	if conf.DryRun {
+		for _, repoName := range repoNames {
+			fmt.Println(strings.Join(cache.UpdateCommandLine(cacheDir, repoName, cfg.Depth), " "))
+		}
+		return nil
+	}
+
+	// Otherwise, update the cached repositories and run their post-checkout command.
+	for _, repoName := range repoNames {
+		ctx, cancel := gitContext(conf)
+		err := cache.UpdateRepo(ctx, cacheDir, repoName, cfg.Depth)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if err := cache.RunHook(conf.CachePath(repoName), cfg.PostCheckout); err != nil {
+			return err
+		}
+	}
+
+	// Compose the sources again to pick up files added or removed by the update.
+	if err := composeConfig(conf, name, cfg); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("updated configuration: %s\n", name)
+	}
+	return nil
+}
+
+// fetchConfigs clones the git repositories of configurations not yet in the
+// cache, so they are ready before they are first used. It reports the result
+// for each configuration and continues past failures.
+func fetchConfigs(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Verify correct usage, fetching all git-backed configs if none are named.
+	names := c.Args().Slice()
+	for _, name := range names {
+		cfg, exists := appState.Configs[name]
+		if !exists {
+			return errors.ConfigNotFoundError{Name: name}
+		}
+		if !isGitBacked(conf, cfg) {
+			return errors.ConfigNotGitBackedError{Name: name}
+		}
+	}
+	if len(names) == 0 {
+		for name, cfg := range appState.Configs {
+			if isGitBacked(conf, cfg) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	// Fetch each config, reporting failures and moving on to the next.
+	var failed []string
+	changed := false
+	for _, name := range names {
+		cfg := appState.Configs[name]
+		result, err := fetchConfig(c, name, &cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: failed: %s\n", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		if !cfg.Equal(appState.Configs[name]) {
+			appState.Configs[name] = cfg
+			changed = true
+		}
+		if !conf.Quiet {
+			fmt.Printf("%s: %s\n", name, result)
+		}
+	}
+
+	// Save the repository URLs and init directories learned along the way.
+	if changed && !conf.DryRun {
+		if err := state.Save(appState, conf.StatePath()); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return errors.ConfigFetchError{Names: failed}
+	}
+	return nil
+}
+
+// fetchConfig clones the git repositories backing a configuration that are
+// not yet in the cache, or all of them with --force, and returns the result
+// to report. URLs of configurations cloned before they were recorded in the
+// state are read from their cached repository.
+func fetchConfig(c *cli.Context, name string, cfg *state.EmacsConfig) (string, error) {
+	conf := appConfig(c)
+	cacheDir := conf.CachePath()
+
+	// Find the URLs of the repositories backing the config.
+	urls := map[string]string{}
+	if len(cfg.Sources) > 0 {
+		for i, source := range cfg.Sources {
+			if util.IsGitURL(source) {
+				urls[sourceRepoName(name, i)] = source
+			}
+		}
+	} else {
+		if cfg.URL == "" && cache.IsCached(cacheDir, name) {
+			ctx, cancel := gitContext(conf)
+			info, err := cache.GetRepoInfo(ctx, cacheDir, name)
+			cancel()
+			if err != nil {
+				return "", err
+			}
+			cfg.URL = info.URL
+		}
+		if cfg.URL == "" {
+			return "", errors.ConfigURLUnknownError{Name: name}
+		}
+		urls[name] = cfg.URL
+	}
+
+	// Skip the repositories already in the cache unless forced.
+	var repoNames []string
+	for _, repoName := range configRepoNames(name, *cfg) {
+		if c.Bool("force") || !cache.IsCached(cacheDir, repoName) {
+			repoNames = append(repoNames, repoName)
+		}
+	}
+	if len(repoNames) == 0 {
+		return "already cached", nil
+	}
+
+	// If is a dry run, print the clones that would be run and return.
+	if conf.DryRun {
+		for _, repoName := range repoNames {
+			printClone(conf, repoName, urls[repoName], cfg.Depth)
+		}
+		return "would fetch", nil
+	}
+
+	// Otherwise, clone the repositories, replacing those already in the cache.
+	for _, repoName := range repoNames {
+		if !cache.IsCached(cacheDir, repoName) {
+			if _, err := cloneConfig(conf, repoName, urls[repoName], cfg.Depth); err != nil {
+				return "", err
+			}
+		} else {
+			ctx, cancel := gitContext(conf)
+			_, err := cache.ReplaceRepo(ctx, cacheDir, repoName, urls[repoName], cfg.Depth)
+			cancel()
+			if err != nil {
+				return "", err
+			}
+		}
+		if err := runPostCheckout(c, conf.CachePath(repoName), cfg.PostCheckout); err != nil {
+			return "", err
+		}
+	}
+	if len(cfg.Sources) == 0 {
+		cfg.InitDir = conf.CachePath(name)
+	}
+	if err := composeConfig(conf, name, *cfg); err != nil {
+		return "", err
+	}
+	return "fetched", nil
+}
+
+// isGitBacked checks if a configuration is cloned from git, either itself or
+// some of the sources it is composed from.
+func isGitBacked(conf *config.Config, cfg state.EmacsConfig) bool {
+	if len(cfg.Sources) > 0 {
+		return slices.ContainsFunc(cfg.Sources, util.IsGitURL)
+	}
+	return cfg.URL != "" || filepath.Dir(cfg.InitDir) == conf.CachePath()
+}
+
+// removeConfig removes a configuration from the state file.
+func removeConfig(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	name := c.Args().Get(0)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the config in the application state.
+	cfg, exists := appState.Configs[name]
+	if !exists {
+		return errors.ConfigNotFoundError{Name: name}
+	}
+
+	// Ensure no environment still uses the config unless forced.
+	if references := appState.ConfigReferences(name); len(references) > 0 && !c.Bool("force") {
+		return errors.ConfigInUseError{Name: name, Environments: references}
+	}
+
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Otherwise, ensure the removal is intended, warning about cached repositories deleted with it.
+	cacheDir := conf.CachePath()
+	prompt := fmt.Sprintf("Remove configuration %s?", name)
+	for _, repoName := range configRepoNames(name, cfg) {
+		if cache.IsCached(cacheDir, repoName) {
+			prompt = fmt.Sprintf("Remove configuration %s and delete its cached repository %s?", name, conf.CachePath(repoName))
+		}
+	}
+	if !confirmRemoval(c, prompt) {
+		return errors.AbortedError
+	}
+
+	// Remove any cached repositories and composed directory from the filesystem.
+	if err := removeConfigFiles(conf, name, cfg); err != nil {
+		return err
+	}
+
+	// Remove config from the application state and save it back to the state file.
+	if err := appState.RemoveConfig(name); err != nil {
+		return err
+	}
+	if err := state.Save(appState, conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("removed configuration: %s\n", name)
+	}
+	return nil
+}
+
+// removeConfigFiles removes the cached repositories and composed directory of
+// a configuration from the filesystem, if it has any.
+func removeConfigFiles(conf *config.Config, name string, cfg state.EmacsConfig) error {
+	cacheDir := conf.CachePath()
+	for _, repoName := range configRepoNames(name, cfg) {
+		if err := cache.RemoveRepo(cacheDir, repoName); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Sources) > 0 {
+		return os.RemoveAll(conf.ComposedPath(name))
+	}
+	return nil
+}
+
+// collectConfigGarbage removes all cached repositories not used by any
+// configuration in the state file, such as those of configurations removed
+// or renamed outside the application.
+func collectConfigGarbage(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the orphaned cached repositories, and if there are none, there's nothing else to do.
+	var known []string
+	for name, cfg := range appState.Configs {
+		known = append(known, configRepoNames(name, cfg)...)
+	}
+	cacheDir := conf.CachePath()
+	orphans, err := cache.Orphans(cacheDir, known)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	// If is a dry run or not forced, list what would be removed and return.
+	if conf.DryRun || !c.Bool("force") {
+		for _, name := range orphans {
+			fmt.Printf("would remove %s\n", filepath.Join(cacheDir, name))
+		}
+		if conf.DryRun {
+			return nil
+		}
+		return errors.ForceRequiredError{Action: "remove orphaned cached repositories"}
+	}
+
+	// Otherwise, remove them, measuring the disk space reclaimed as we go.
+	var reclaimed int64
+	for _, name := range orphans {
+		size, err := cache.RepoSize(cacheDir, name)
+		if err != nil {
+			return err
+		}
+		if err := cache.RemoveRepo(cacheDir, name); err != nil {
+			return err
+		}
+		reclaimed += size
+		if !conf.Quiet {
+			fmt.Printf("removed %s\n", filepath.Join(cacheDir, name))
+		}
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("reclaimed %s\n", util.FormatSize(reclaimed))
+	}
+	return nil
+}
+
+// search prints a table of all entities in the state file matching a term.
+func search(c *cli.Context) error {
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	term := c.Args().Get(0)
+
+	// Load the application state.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Search it and print the matches in the desired output format.
+	results, err := appState.Search(term, c.Bool("regex"))
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(results))
+	for _, result := range results {
+		rows = append(rows, []string{result.Kind, result.Name, result.Description})
+	}
+	return renderRows(c, []string{"Kind", "Name", "Description"}, rows)
+}
+
+// prune removes environments referencing missing commands or configurations
+// from the state file, along with any context referencing a missing environment.
+func prune(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Prune dangling references, and if there are none, there's nothing else to do.
+	pruned := appState.Prune()
+	if len(pruned) == 0 {
+		return nil
+	}
+
+	// If is a dry run or not forced, list what would be pruned and return.
+	if conf.DryRun || !c.Bool("force") {
+		for _, line := range pruned {
+			fmt.Printf("would prune %s\n", line)
+		}
+		if conf.DryRun {
+			return nil
+		}
+		return errors.ForceRequiredError{Action: "prune"}
+	}
+
+	// Otherwise, save the pruned application state back to the state file.
+	if err := state.Save(appState, conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if !conf.Quiet {
+		for _, line := range pruned {
+			fmt.Printf("pruned %s\n", line)
+		}
+	}
+	return nil
+}
+
+// cacheInfoHeaders are the column headers of cache repository information.
+var cacheInfoHeaders = []string{"Name", "URL", "Branch", "Commit", "Dirty", "Size"}
+
+// cacheInfoRow returns the row of values displayed for cache repository information.
+func cacheInfoRow(info cache.RepoInfo) []string {
+	return []string{info.Name, info.URL, info.Branch, info.Commit, strconv.FormatBool(info.Dirty), util.FormatSize(info.Size)}
+}
+
+// listCache prints a table of all repositories in the cache directory.
+func listCache(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// List the cached repositories.
+	cacheDir := conf.CachePath()
+	names, err := cache.ListRepos(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	// Print information about all of them in the desired output format.
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		ctx, cancel := gitContext(conf)
+		info, err := cache.GetRepoInfo(ctx, cacheDir, name)
+		cancel()
+		if err != nil {
+			return err
+		}
+		rows = append(rows, cacheInfoRow(info))
+	}
+	return renderRows(c, cacheInfoHeaders, rows)
+}
+
+// showCacheInfo prints information about a repository in the cache directory.
+func showCacheInfo(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	name := c.Args().Get(0)
+
+	// Ensure the repository is cached.
+	cacheDir := conf.CachePath()
+	if !cache.IsCached(cacheDir, name) {
+		return errors.ConfigNotCachedError{Name: name}
+	}
+
+	// Print its information in the desired output format.
+	ctx, cancel := gitContext(conf)
+	defer cancel()
+	info, err := cache.GetRepoInfo(ctx, cacheDir, name)
+	if err != nil {
+		return err
+	}
+	return renderRows(c, cacheInfoHeaders, [][]string{cacheInfoRow(info)})
+}
+
+// showCacheSize prints the disk usage of all repositories in the cache directory.
+func showCacheSize(c *cli.Context) error {
+	// List the cached repositories.
+	cacheDir := appConfig(c).CachePath()
+	names, err := cache.ListRepos(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	// Print the size of each of them in the desired output format.
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		size, err := cache.RepoSize(cacheDir, name)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []string{name, util.FormatSize(size)})
+	}
+	return renderRows(c, []string{"Name", "Size"}, rows)
+}
+
+// showState prints the application state.
+func showState(c *cli.Context) error {
+	// If only part of the state is requested, print just that part.
+	switch only := c.String("only"); only {
+	case "":
+	case "context":
+		return showContext(c)
+	default:
+		return errors.InvalidValueError{Name: "only", Value: only}
+	}
+
+	// Otherwise, load the application state and print it to stdout.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(appState, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// sortRows sorts rows of list output by the column with a header matching by,
+// breaking ties by the first, name, column.
+func sortRows(rows [][]string, headers []string, by string) error {
+	column := slices.IndexFunc(headers, func(header string) bool { return strings.EqualFold(header, by) })
+	if column < 0 {
+		return errors.InvalidValueError{Name: "sort", Value: by}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i][column] != rows[j][column] {
+			return rows[i][column] < rows[j][column]
+		}
+		return rows[i][0] < rows[j][0]
+	})
+	return nil
+}
+
+// renderRows prints rows in the output format selected by the --output flag,
+// or with the template provided with the --format flag. When output is
+// quieted, nothing is printed unless only names or a template are requested.
+func renderRows(c *cli.Context, headers []string, rows [][]string) error {
+	return renderEntityRows[any](c, headers, rows, nil)
+}
+
+// renderEntityRows prints rows like renderRows, the template provided with the
+// --format flag also having access to the fields of the entity named by the
+// first column of each row.
+func renderEntityRows[V any](c *cli.Context, headers []string, rows [][]string, entities map[string]V) error {
+	if text := c.String("format"); text != "" {
+		if c.IsSet("output") {
+			return errors.ConflictingFlagsError{First: "--format", Second: "--output"}
+		}
+		items := make([]map[string]any, len(rows))
+		for i, row := range rows {
+			items[i] = map[string]any{}
+			if entity, ok := entities[row[0]]; ok {
+				maps.Copy(items[i], structFields(entity))
+			}
+			for j, header := range headers {
+				items[i][strings.ReplaceAll(header, " ", "")] = row[j]
+			}
+		}
+		return render.Template(os.Stdout, text, items)
+	}
+
+	format := c.String("output")
+	if appConfig(c).Quiet && format != render.Names {
+		return nil
+	}
+	return render.Rows(os.Stdout, format, headers, rows)
+}
+
+// timestampHeaders are the headers of the columns of lists showing when
+// entities were created and last updated.
+var timestampHeaders = []string{"Created", "Updated"}
+
+// withTimestamps checks if lists show when entities were created and last
+// updated, which they do when wide or in a structured output format.
+func withTimestamps(c *cli.Context) bool {
+	switch c.String("output") {
+	case render.JSON, render.TOML:
+		return true
+	}
+	return c.Bool("wide")
+}
+
+// structFields returns the exported fields of a struct keyed by field name.
+func structFields(v any) map[string]any {
+	fields := map[string]any{}
+	value := reflect.ValueOf(v)
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Type().Field(i); field.IsExported() {
+			fields[field.Name] = value.Field(i).Interface()
+		}
+	}
+	return fields
+}
+
+// loadState loads the application state from a state file, or returns the
+// default state if it does not exist.
+func loadState(path string) (*state.State, error) {
+	slog.Debug("loading state", "path", path)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// The default state requires the home directory to locate the default emacs configuration.
+		if config.DefaultEmacsConfigDir == "" {
+			return nil, errors.NoHomeDirError
+		}
+	}
+	return state.Load(path, config.DefaultEmacsCommandLine, config.DefaultEmacsConfigDir)
+}
+
+// printJSON prints a value to stdout as indented JSON.
+func printJSON(v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+// showStatePath prints the path of the application state file.
+func showStatePath(c *cli.Context) error {
+	fmt.Println(appConfig(c).StatePath())
+	return nil
+}
+
+// showStateSchema prints the JSON Schema of the application state file.
+func showStateSchema(_ *cli.Context) error {
+	return printJSON(schema.Generate(config.AppName+" state", state.State{}))
+}
+
+// initState sets up the application state file with a default command, config,
+// and environment, prompting for anything not provided by flags when interactive.
+func initState(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Ensure any existing state is not overwritten unless forced.
+	path := conf.StatePath()
+	if _, err := os.Stat(path); err == nil && !c.Bool("force") {
+		return errors.StateExistsError{Path: path}
+	}
+	interactive := util.IsInteractive()
+
+	// Determine the emacs binary to use, detecting it if not provided.
+	emacsPath := c.String("emacs-path")
+	if emacsPath == "" {
+		detected, err := detectEmacs(c)
+		if err != nil && !interactive {
+			return err
+		}
+		emacsPath = detected
+		if interactive && (emacsPath == "" || !util.Confirm(fmt.Sprintf("Create default command using %s?", emacsPath))) {
+			if emacsPath, err = util.Prompt("Emacs binary path", config.DefaultEmacsCommandLine); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Determine the emacs configuration to use, prompting for it if not provided.
+	// Directories are expanded here, as the shell never sees prompted input.
+	configDir := c.String("config-dir")
+	if configDir == "" {
+		configDir = config.DefaultEmacsConfigDir
+		if interactive {
+			var err error
+			if configDir, err = util.Prompt("Emacs configuration directory or git URL", configDir); err != nil {
+				return err
+			}
+		}
+	}
+	if !util.IsGitURL(configDir) {
+		var err error
+		if configDir, err = config.ExpandPath(configDir); err != nil {
+			return err
+		}
+		if configDir, err = filepath.Abs(configDir); err != nil {
+			return err
+		}
+	}
+
+	version := verifyEmacs(c, emacsPath)
+
+	// If is a dry run, print what would be set up and return.
+	if conf.DryRun {
+		if util.IsGitURL(configDir) {
+			printClone(conf, "default", configDir, 0)
+		}
+		fmt.Printf("would initialize state: command %s, config %s\n", emacsPath, configDir)
+		return nil
+	}
+
+	// Otherwise, clone any git-backed configuration and save the new state.
+	var url string
+	if util.IsGitURL(configDir) {
+		var err error
+		url = configDir
+		if configDir, err = cloneConfig(conf, "default", configDir, 0); err != nil {
+			return err
+		}
+	}
+	appState := state.New(emacsPath, configDir)
+	command := appState.Commands["default"]
+	command.Version = version
+	appState.Commands["default"] = command
+	cfg := appState.Configs["default"]
+	cfg.URL = url
+	appState.Configs["default"] = cfg
+	if err := state.Save(appState, path); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("initialized state: %s\n", path)
+	}
+	return nil
+}
+
+// editState opens the application state file in the user's editor and
+// validates it after the editor exits.
+func editState(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Determine the editor command line to use.
+	path := conf.StatePath()
+	editor, err := shellwords.Split(os.Getenv("EDITOR"))
+	if err != nil {
+		return err
+	}
+	if len(editor) == 0 {
+		editor = []string{config.DefaultEmacsCommandLine}
+	}
+	cmdLine := append(editor, path)
+
+	// If is a dry run, print the command line and return.
+	if conf.DryRun {
+		fmt.Println(strings.Join(cmdLine, " "))
+		return nil
+	}
+
+	// Ensure the state file exists and back it up before editing it.
+	appState, err := loadState(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := state.Save(appState, path); err != nil {
+			return err
+		}
+	}
+	if err := state.Backup(path); err != nil {
+		return err
+	}
+
+	// Edit the state file.
+	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := runCommand(appRunner(c), cmd); err != nil {
+		return err
+	}
+
+	// Validate the edited state file, offering to restore the backup if invalid.
+	appState, err = loadState(path)
+	if err == nil {
+		err = appState.Validate()
+	}
+	if err == nil {
+		return nil
+	}
+	fmt.Printf("warning: edited state is invalid: %s\n", err)
+	if !util.Confirm("Restore the state from before editing?") {
+		return err
+	}
+	if err := state.Restore(path); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("restored state: %s\n", state.BackupPath(path))
+	}
+	return nil
+}
+
+// importState merges another state file into the application state file.
+func importState(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	if c.IsSet("archive") {
+		if c.NArg() != 0 {
+			return errors.UnexpectedNumArgsError{Expected: 0, Received: c.NArg()}
+		}
+		return importArchive(c)
+	}
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	path := c.Args().Get(0)
+
+	// Load the application state and the state to import.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+	importedState, err := readStateFile(path, c.String("format"))
+	if err != nil {
+		return err
+	}
+
+	// Merge the imported state and report the changes.
+	report := appState.Merge(importedState, c.Bool("dedup"))
+	printMergeReport(conf, report)
+
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Otherwise, save the merged state back to the state file.
+	return state.Save(appState, conf.StatePath())
+}
+
+// printMergeReport prints the changes made by merging an imported state.
+func printMergeReport(conf *config.Config, report state.MergeReport) {
+	if !conf.Quiet {
+		for _, line := range report.Added {
+			fmt.Printf("added %s\n", line)
+		}
+		for _, line := range report.Renamed {
+			fmt.Printf("renamed %s\n", line)
+		}
+		for _, line := range report.Deduped {
+			fmt.Printf("deduped %s\n", line)
+		}
+	}
+	if conf.Verbose {
+		for _, line := range report.Skipped {
+			fmt.Printf("skipped identical %s\n", line)
+		}
+	}
+}
+
+// exportState prints the state file in the desired format, or writes an
+// archive of the state file and the directories of its local configurations,
+// with their init directories rewritten relative to the archive. Git-backed
+// configurations are recorded by repository URL, and configurations composed
+// from sources by their sources, rather than bundled.
+func exportState(c *cli.Context) error {
+	conf := appConfig(c)
+	archivePath := c.String("archive")
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Without an archive, just print the state.
+	if archivePath == "" {
+		return printState(appState, c.String("output"))
+	}
+
+	// Rewrite the configurations of a copy of the state for the archive.
+	exported := appState.Clone()
+	configDirs := map[string]string{}
+	for name, cfg := range exported.Configs {
+		switch {
+		case len(cfg.Sources) > 0:
+			cfg.InitDir = ""
+		case cfg.URL != "":
+			cfg.InitDir = cfg.URL
+		case filepath.Dir(cfg.InitDir) == conf.CachePath():
+			ctx, cancel := gitContext(conf)
+			info, err := cache.GetRepoInfo(ctx, conf.CachePath(), filepath.Base(cfg.InitDir))
+			cancel()
+			if err != nil {
+				return err
+			}
+			cfg.InitDir = info.URL
+		case configStatus(conf, cfg) == configStatusMissing:
+			fmt.Fprintf(os.Stderr, "warning: not bundling missing init directory of configuration %s: %s\n", name, cfg.InitDir)
+			continue
+		default:
+			configDirs[name] = cfg.InitDir
+			cfg.InitDir = archive.ConfigPath(name)
+		}
+		exported.Configs[name] = cfg
+	}
+	data, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// If is a dry run, print the state the archive would contain and return.
+	if conf.DryRun {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	// Otherwise, write the archive.
+	if err := archive.Write(archivePath, data, configDirs); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("exported state: %s\n", archivePath)
+	}
+	return nil
+}
+
+// printState prints a state in the desired format.
+func printState(s *state.State, format string) error {
+	switch format {
+	case "json":
+		return printJSON(s)
+	case "toml":
+		data, err := toml.Marshal(s)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(data))
+		return nil
+	default:
+		return errors.InvalidValueError{Name: "output", Value: format}
+	}
+}
+
+// readStateFile reads a state file in the desired format, detected from its
+// extension if not provided, migrating it from older versions of the format.
+func readStateFile(path, format string) (*state.State, error) {
+	if format == "" {
+		format = "json"
+		if strings.EqualFold(filepath.Ext(path), ".toml") {
+			format = "toml"
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "json":
+	case "toml":
+		var doc map[string]any
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.InvalidValueError{Name: "format", Value: format}
+	}
+	return state.Migrate(data)
+}
+
+// importArchive merges the state of an archive written by exportState into the
+// state file, unpacking its bundled configuration directories next to the
+// state file and cloning its git-backed configurations again.
+func importArchive(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Extract the archive next to the state file, so that its configurations
+	// can be moved into place, and load the state it contains.
+	tempDir, err := os.MkdirTemp(filepath.Dir(conf.StatePath()), ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := archive.Extract(c.String("archive"), tempDir); err != nil {
+		return err
+	}
+	statePath := filepath.Join(tempDir, archive.StateName)
+	if _, err := os.Stat(statePath); err != nil {
+		return err
+	}
+	importedState, err := loadState(statePath)
+	if err != nil {
+		return err
+	}
+
+	// Rename the imported configurations conflicting with existing ones before
+	// restoring them, as their directories are named after them.
+	if err := renameImportedConfigs(conf, appState, importedState); err != nil {
+		return err
+	}
+
+	// If is a dry run, report what would be merged and return.
+	if conf.DryRun {
+		printMergeReport(conf, appState.Clone().Merge(importedState, c.Bool("dedup")))
+		return nil
+	}
+
+	// Otherwise, restore the configurations in a transaction, so that a failure
+	// midway leaves no unpacked or cloned directories behind.
+	tx := appState.Begin()
+	for name, cfg := range importedState.Configs {
+		if err := restoreConfig(c, tx, tempDir, name, &cfg); err != nil {
+			return rollback(tx, err)
+		}
+		importedState.Configs[name] = cfg
+	}
+
+	// Merge the imported state and save it back to the state file.
+	report := tx.State.Merge(importedState, c.Bool("dedup"))
+	if err := state.Save(tx.State, conf.StatePath()); err != nil {
+		return rollback(tx, err)
+	}
+	tx.Commit()
+
+	// Success!
+	printMergeReport(conf, report)
+	return nil
+}
+
+// renameImportedConfigs renames the configurations of an imported state having
+// the name of a configuration of the application state to a free name.
+func renameImportedConfigs(conf *config.Config, appState, importedState *state.State) error {
+	names := make([]string, 0, len(importedState.Configs))
+	for name := range importedState.Configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !appState.ConfigExists(name) {
+			continue
+		}
+		newName := name
+		for i := 2; appState.ConfigExists(newName) || importedState.ConfigExists(newName); i++ {
+			newName = fmt.Sprintf("%s-%d", name, i)
+		}
+		if err := importedState.RenameConfig(name, newName); err != nil {
+			return err
+		}
+		if conf.Verbose {
+			fmt.Printf("importing config %s as %s\n", name, newName)
+		}
+	}
+	return nil
+}
+
+// restoreConfig restores the init directory of a configuration imported from
+// an extracted archive, updating it to the restored location.
+func restoreConfig(c *cli.Context, tx *state.Transaction, archiveDir, name string, cfg *state.EmacsConfig) error {
+	conf := appConfig(c)
+	switch {
+	case len(cfg.Sources) > 0:
+		for i, source := range cfg.Sources {
+			if !util.IsGitURL(source) {
+				continue
+			}
+			repoName := sourceRepoName(name, i)
+			if _, err := cloneConfig(conf, repoName, source, cfg.Depth); err != nil {
+				return err
+			}
+			tx.OnRollback(func() error { return cache.RemoveRepo(conf.CachePath(), repoName) })
+		}
+		cfg.InitDir = conf.ComposedPath(name)
+		tx.OnRollback(func() error { return os.RemoveAll(conf.ComposedPath(name)) })
+		return composeConfig(conf, name, *cfg)
+	case util.IsGitURL(cfg.InitDir):
+		repoDir, err := cloneConfig(conf, name, cfg.InitDir, cfg.Depth)
+		if err != nil {
+			return err
+		}
+		tx.OnRollback(func() error { return cache.RemoveRepo(conf.CachePath(), name) })
+		cfg.URL = cfg.InitDir
+		cfg.InitDir = repoDir
+		return runPostCheckout(c, repoDir, cfg.PostCheckout)
+	case !filepath.IsAbs(cfg.InitDir) && strings.HasPrefix(cfg.InitDir, archive.ConfigsDir+"/"):
+		// Only restore a directory bundled in the archive, as a hostile state
+		// could otherwise move any directory the archive path reaches.
+		rel := filepath.FromSlash(cfg.InitDir)
+		if !filepath.IsLocal(rel) || filepath.Dir(filepath.Clean(rel)) != archive.ConfigsDir {
+			return errors.UnsafeArchiveEntryError{Name: cfg.InitDir}
+		}
+		dir := conf.ConfigsPath(name)
+		if _, err := os.Stat(dir); err == nil {
+			return &fs.PathError{Op: "import", Path: dir, Err: fs.ErrExist}
+		}
+		if err := util.EnsureDir(conf.ConfigsPath()); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(archiveDir, rel), dir); err != nil {
+			return err
+		}
+		tx.OnRollback(func() error { return os.RemoveAll(dir) })
+		cfg.InitDir = dir
+	}
+	return nil
+}
+
+// diffState prints the differences between the state file and another state
+// file, that is what would change if the state were replaced by the other one.
+func diffState(c *cli.Context) error {
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	path := c.Args().Get(0)
+
+	// Load the application state and the state to compare it with.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+	otherState, err := readStateFile(path, "")
+	if err != nil {
+		return err
+	}
+	diff := appState.Diff(otherState)
+
+	// Print the differences in the requested format.
+	switch output := c.String("output"); output {
+	case "json":
+		return printJSON(diff)
+	case "text":
+		printDelta("command", diff.Commands)
+		printDelta("config", diff.Configs)
+		printDelta("environment", diff.Environments)
+		if diff.OldContext != diff.NewContext {
+			fmt.Printf("~ context %s -> %s\n", valueOrNone(diff.OldContext), valueOrNone(diff.NewContext))
+		}
+		if diff.OldDefault != diff.NewDefault {
+			fmt.Printf("~ default %s -> %s\n", valueOrNone(diff.OldDefault), valueOrNone(diff.NewDefault))
+		}
+		return nil
+	default:
+		return errors.InvalidValueError{Name: "output", Value: output}
+	}
+}
+
+// valueOrNone returns a value, or none if it is empty.
+func valueOrNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
+
+// printDelta prints the names of entities of a kind added, removed, or changed
+// between two states, prefixed with +, -, or ~ respectively.
+func printDelta(kind string, delta state.Delta) {
+	for _, name := range delta.Added {
+		fmt.Printf("+ %s %s\n", kind, name)
+	}
+	for _, name := range delta.Removed {
+		fmt.Printf("- %s %s\n", kind, name)
+	}
+	for _, name := range delta.Changed {
+		fmt.Printf("~ %s %s\n", kind, name)
+	}
+}
+
+// restoreState swaps the application state file with its backup.
+func restoreState(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Otherwise, swap the backup into place.
+	if err := state.Restore(conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("restored state: %s\n", state.BackupPath(conf.StatePath()))
+	}
+	return nil
+}
+
+// resetState replaces the state file with the default state, backing up the
+// previous state file so that it can be restored.
+func resetState(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// The default state requires the home directory to locate the default emacs configuration.
+	if config.DefaultEmacsConfigDir == "" {
+		return errors.NoHomeDirError
+	}
+	appState := state.New(config.DefaultEmacsCommandLine, config.DefaultEmacsConfigDir)
+
+	// If is a dry run, print the state the reset would produce and return.
+	if conf.DryRun {
+		return printJSON(appState)
+	}
+
+	// Otherwise, refuse to discard the state unless forced to.
+	if !c.Bool("force") {
+		return errors.ForceRequiredError{Action: "reset the state"}
+	}
+	if err := state.Save(appState, conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		fmt.Printf("reset state: %s, previous state backed up to %s\n", conf.StatePath(), state.BackupPath(conf.StatePath()))
+	}
+	return nil
+}
+
+// getContext prints the active configuration context in the state file.
+func getContext(c *cli.Context) error {
+	// Load the application state.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Print the active context.
+	fmt.Println(appState.Context)
+	return nil
+}
+
+// showContext prints a report of how the environment context resolves and the
+// command line that would be executed by open.
+func showContext(c *cli.Context) error {
+	// Load the application state.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Report where the context comes from, if anywhere.
+	context, err := resolveContext(c, appState)
+	if err != nil {
+		fmt.Printf("context:      none\nresolved:     no (%s)\n", err)
+		return nil
+	}
+	source := "state"
+	if c.String("context") != "" {
+		source = "--context flag"
+	} else if appState.Context == "" {
+		source = "default environment"
+	}
+	fmt.Printf("context:      %s (from %s)\n", context, source)
+
+	// Report how the environment resolves.
+	env, err := appState.Resolve(context)
+	if err != nil {
+		fmt.Printf("resolved:     no (%s)\n", err)
+		return nil
+	}
+	fmt.Printf("command:      %s (%s)\n", env.Environment.CommandName, env.Command.BinPath)
+	fmt.Printf("config:       %s (%s)\n", env.Environment.ConfigName, env.Config.InitDir)
+	fmt.Printf("resolved:     yes\n")
+	fmt.Printf("command line: %s\n", strings.Join(env.CommandLine(), " "))
+	return nil
+}
+
+// setContext sets the active configuration context in the state file.
+func setContext(c *cli.Context) error {
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	return switchContext(appConfig(c), c.Args().Get(0))
+}
+
+// activateEnvironment sets an environment as the active configuration context in the state file.
+func activateEnvironment(c *cli.Context) error {
+	// Verify correct usage.
+	if c.NArg() != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: c.NArg()}
+	}
+	return switchContext(appConfig(c), c.Args().Get(0))
+}
+
+// switchContext validates that an environment exists and sets it as the
+// active configuration context in the state file.
+func switchContext(conf *config.Config, name string) error {
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the environment in the application state.
+	if _, exists := appState.Environments[name]; !exists {
+		return errors.EnvironmentNotFoundError{Name: name}
+	}
+
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Otherwise, set the active context and save it back to the state file.
+	previous := appState.Context
+	if err := appState.SetContext(name); err != nil {
+		return err
+	}
+	if err := state.Save(appState, conf.StatePath()); err != nil {
+		return err
+	}
+
+	// Success!
+	if conf.Verbose {
+		env, err := appState.Resolve(name)
+		if err != nil {
+			fmt.Printf("warning: context '%s' does not resolve: %s\n", name, err)
+			return nil
+		}
+		fmt.Printf("context set to '%s' from '%s' (%s → %s)\n", name, previous, env.Command.BinPath, env.Config.InitDir)
+	}
+	return nil
+}
+
+// clearContext clears the active configuration context in the state file.
+func clearContext(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// If is a dry run, there's nothing else to do.
+	if conf.DryRun {
+		return nil
+	}
+
+	// Otherwise, clear the active context and save it back to the state file.
+	if err := appState.SetContext(""); err != nil {
+		return err
+	}
+	return state.Save(appState, conf.StatePath())
+}
+
+// previousContext switches back to the previous context in the context history.
+func previousContext(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Find the previous context in the context history and switch to it.
+	name, err := appState.PreviousContext()
+	if err != nil {
+		return err
+	}
+	return switchContext(conf, name)
+}
+
+// showContextHistory prints the previous contexts in the state file, most recent first.
+func showContextHistory(c *cli.Context) error {
+	// Load the application state.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Print the context history.
+	for _, name := range appState.ContextHistory {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// openEmacs opens emacs with the desired configuration and all provided arguments.
+func openEmacs(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Verify correct usage.
+	evals := c.StringSlice("eval")
+	for _, flag := range []string{"client", "reuse-or-new"} {
+		if c.Bool(flag) && c.Bool("batch") {
+			return errors.ConflictingFlagsError{First: "--batch", Second: "--" + flag}
+		}
+		if c.Bool(flag) && len(evals) > 0 {
+			return errors.ConflictingFlagsError{First: "--eval", Second: "--" + flag}
+		}
+	}
+	for _, flag := range []string{"no-wait", "detach"} {
+		if c.Bool(flag) && c.Bool("wait") {
+			return errors.ConflictingFlagsError{First: "--wait", Second: "--" + flag}
+		}
+	}
+	opts, err := newLaunchOptions(c)
+	if err != nil {
+		return err
+	}
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Ensure an environment is selected.
+	context, files, err := selectEnvironment(c, appState)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the environment's command and config.
+	env, err := appState.Resolve(context)
+	if err != nil {
+		return err
+	}
+	logResolved(env)
+	cmd := env.Command
+
+	// Compose a configuration composed from sources again to pick up changes
+	// to them, and ensure it exists rather than letting emacs fail confusingly.
+	if !conf.DryRun {
+		if err := checkFetched(conf, env.Environment.ConfigName, env.Config); err != nil {
+			return err
+		}
+		if err := composeConfig(conf, env.Environment.ConfigName, env.Config); err != nil {
+			return err
+		}
+		if err := checkInitDir(conf, env.Environment.ConfigName, env.Config); err != nil {
+			return err
+		}
+	}
+
+	// Build the command line to execute, in batch mode and evaluating forms if requested.
+	cmdLine := env.CommandLine()
+	if c.Bool("batch") {
+		cmdLine = slices.Insert(cmdLine, 1, "--batch")
+	}
+	for _, form := range evals {
+		cmdLine = append(cmdLine, "--eval", form)
+	}
+	cmdLine = append(cmdLine, files...)
+
+	// If requested, open files with emacs client in a server for the environment.
+	if opts.environ, err = env.Environment.Environ(); err != nil {
+		return err
+	}
+	if opts.dir == "" {
+		opts.dir = env.Environment.WorkingDir
+	}
+	opts.preHook = env.Environment.PreHook
+	opts.postHook = env.Environment.PostHook
+	if c.Bool("client") {
+		return openClient(conf, env, files, opts)
+	}
+
+	// If requested, attach to a running emacs server for the environment
+	// instead. In a dry run, both the attempt and the fallback are printed.
+	if c.Bool("reuse-or-new") {
+		clientLine := cmd.ClientCommandLine(context, files)
+		if !c.Bool("wait") {
+			clientLine = slices.Insert(clientLine, 1, "--no-wait")
+		}
+		if conf.DryRun || opts.print {
+			opts.printDir()
+			opts.printEnviron()
+			opts.printHook(opts.preHook)
+			fmt.Printf("%s || %s\n", strings.Join(clientLine, " "), strings.Join(cmdLine, " "))
+			opts.printAfterInit()
+			opts.printHook(opts.postHook)
+			if conf.DryRun {
+				return nil
+			}
+			opts.print = false
+		}
+		running, err := daemon.IsRunning(runWith(opts.runner), cmd.Client(), context)
+		if err != nil {
+			return err
+		}
+		if running {
+			if conf.Verbose {
+				fmt.Printf("emacs server %s is running, attaching to it\n", context)
+			}
+			cmdLine = clientLine
+		} else if conf.Verbose {
+			fmt.Printf("emacs server %s is not running, starting new emacs\n", context)
+		}
+	}
+
+	// Emacs started directly is not waited for only when detached.
+	if opts.noWait {
+		opts.detach = true
+	}
+
+	// If is a dry run, print the command line and return. If requested, print
+	// it without returning.
+	if conf.DryRun || opts.print {
+		opts.printDir()
+		opts.printEnviron()
+		opts.printHook(opts.preHook)
+		fmt.Println(strings.Join(cmdLine, " "))
+		opts.printAfterInit()
+		opts.printHook(opts.postHook)
+		if conf.DryRun {
+			return nil
+		}
+	}
+
+	// Otherwise, execute the command.
+	return runCommandLine(cmdLine, opts)
+}
+
+// openClient opens files with emacs client in a new frame of the environment's
+// emacs server, starting the server first if it is not running.
+func openClient(conf *config.Config, env *state.ResolvedEnvironment, files []string, opts launchOptions) error {
+	daemonLine := env.DaemonCommandLine()
+	clientLine := env.Command.ClientCommandLine(env.Name, files)
+	if opts.noWait {
+		clientLine = slices.Insert(clientLine, 1, "--no-wait")
+	}
+
+	// If is a dry run, print both command lines and return. If requested,
+	// print them without returning.
+	if conf.DryRun || opts.print {
+		opts.printDir()
+		opts.printEnviron()
+		opts.printHook(opts.preHook)
+		fmt.Println(strings.Join(daemonLine, " "))
+		fmt.Println(strings.Join(clientLine, " "))
+		opts.printAfterInit()
+		opts.printHook(opts.postHook)
+		if conf.DryRun {
+			return nil
+		}
+	}
+
+	// Run any pre-hook before the emacs server may be started, rather than
+	// before the client only.
+	if err := opts.runHook("pre", opts.preHook); err != nil {
+		return err
+	}
+	opts.preHook = ""
+
+	// Start the emacs server if it is not already running.
+	running, err := daemon.IsRunning(runWith(opts.runner), env.Command.Client(), env.Name)
+	if err != nil {
+		return err
+	}
+	if !running {
+		if conf.Verbose {
+			fmt.Printf("starting emacs server: %s\n", env.Name)
+		}
+		daemonCmd := exec.Command(daemonLine[0], daemonLine[1:]...)
+		daemonCmd.Env = opts.env()
+		daemonCmd.Dir = opts.dir
+		if err := runCommand(opts.runner, daemonCmd); err != nil {
+			return err
+		}
+	}
+
+	// Open the files in the emacs server.
+	return runCommandLine(clientLine, opts)
+}
+
+// runScript runs an emacs lisp script in batch mode in an environment,
+// streaming its output and exiting with its exit code.
+func runScript(c *cli.Context) error {
+	conf := appConfig(c)
+
+	// Load the application state.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Ensure an environment and a script are selected.
+	context, args, err := selectEnvironment(c, appState)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.UnexpectedNumArgsError{Expected: 1, Received: len(args)}
+	}
+	script := args[0]
+
+	// Resolve the environment's command and config.
+	env, err := appState.Resolve(context)
+	if err != nil {
+		return err
+	}
+	logResolved(env)
+
+	// Build the command line to execute, loading the script in batch mode like --script does.
+	cmdLine := slices.Insert(env.CommandLine(), 1, "--batch")
+	cmdLine = append(cmdLine, "--load", script)
+	environ, err := env.Environment.Environ()
+	if err != nil {
+		return err
+	}
+	opts := launchOptions{
+		environ: environ,
+		dir:     env.Environment.WorkingDir,
+		runner:  appRunner(c),
+	}
+
+	// If is a dry run, print the command line and return.
+	if conf.DryRun {
+		opts.printDir()
+		opts.printEnviron()
+		fmt.Println(strings.Join(cmdLine, " "))
+		return nil
+	}
+
+	// Otherwise, compose the configuration if needed and execute the command.
+	if err := checkFetched(conf, env.Environment.ConfigName, env.Config); err != nil {
+		return err
+	}
+	if err := composeConfig(conf, env.Environment.ConfigName, env.Config); err != nil {
+		return err
+	}
+	if err := checkInitDir(conf, env.Environment.ConfigName, env.Config); err != nil {
+		return err
+	}
+	return runCommandLine(cmdLine, opts)
+}
+
+// launchOptions control how emacs is launched by open.
+type launchOptions struct {
+	// detach starts emacs detached from the terminal without waiting for it.
+	detach bool
+	// noWait returns without waiting for emacs, or for the buffers opened
+	// with emacs client to be done.
+	noWait bool
+	// afterInit is a command line run once emacs has been started.
+	afterInit []string
+	// afterInitDelay is how long to wait after starting emacs before running afterInit.
+	afterInitDelay time.Duration
+	// environ are KEY=VALUE environment variables set for emacs on top of our own.
+	environ []string
+	// dir is the directory to start emacs in, or empty for the current directory.
+	dir string
+	// verbose prints the after init command line before running it.
+	verbose bool
+	// runner runs emacs and any emacs server it connects to.
+	runner Runner
+	// preHook is a shell command run before emacs is started, aborting if it fails.
+	preHook string
+	// postHook is a shell command run after emacs exits.
+	postHook string
+	// print prints the command lines emacs is launched with before launching it.
+	print bool
+}
+
+// newLaunchOptions returns the launch options provided by the flags of open,
+// failing if the after init command line cannot be split.
+func newLaunchOptions(c *cli.Context) (launchOptions, error) {
+	afterInit, err := shellwords.Split(c.String("after-init"))
+	if err != nil {
+		return launchOptions{}, err
+	}
+	return launchOptions{
+		detach:         c.Bool("detach"),
+		noWait:         c.Bool("no-wait"),
+		afterInit:      afterInit,
+		afterInitDelay: c.Duration("after-init-delay"),
+		dir:            c.String("cwd"),
+		verbose:        appConfig(c).Verbose,
+		runner:         appRunner(c),
+		print:          c.Bool("print"),
+	}, nil
+}
+
+// printDir prints the effective directory emacs is started in.
+func (o launchOptions) printDir() {
+	dir := o.dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	fmt.Printf("cd %s\n", dir)
+}
+
+// env returns the environment of the launched emacs process, or nil to inherit ours.
+func (o launchOptions) env() []string {
+	if len(o.environ) == 0 {
+		return nil
+	}
+	return append(os.Environ(), o.environ...)
+}
+
+// printEnviron prints the environment variables set for emacs, if any.
+func (o launchOptions) printEnviron() {
+	for _, variable := range o.environ {
+		fmt.Printf("export %s\n", variable)
+	}
+}
+
+// printHook prints the command line a hook is run with, if any.
+func (o launchOptions) printHook(hook string) {
+	if hook != "" {
+		fmt.Printf("sh -c %s\n", shellwords.Quote(hook))
+	}
+}
+
+// runHook runs a hook with sh -c in the directory and environment of emacs,
+// doing nothing if there is no hook.
+func (o launchOptions) runHook(name, hook string) error {
+	if hook == "" {
+		return nil
+	}
+	if o.verbose {
+		fmt.Printf("running %s hook: %s\n", name, hook)
+	}
+	cmd := exec.Command("sh", "-c", hook)
+	cmd.Env = o.env()
+	cmd.Dir = o.dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := runCommand(o.runner, cmd); err != nil {
+		return errors.HookError{Name: name, Err: err}
+	}
+	return nil
+}
+
+// printAfterInit prints the command line run once emacs has been started, if any.
+func (o launchOptions) printAfterInit() {
+	if len(o.afterInit) > 0 {
+		fmt.Printf("after %s: %s\n", o.afterInitDelay, strings.Join(o.afterInit, " "))
+	}
+}
+
+// runAfterInit runs the command line to run once emacs has been started, if
+// any, after the configured delay. Failures are reported but not returned, as
+// emacs itself has started successfully.
+func (o launchOptions) runAfterInit() {
+	if len(o.afterInit) == 0 {
+		return
+	}
+	time.Sleep(o.afterInitDelay)
+	if o.verbose {
+		fmt.Printf("running after init: %s\n", strings.Join(o.afterInit, " "))
+	}
+	cmd := exec.Command(o.afterInit[0], o.afterInit[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := runCommand(o.runner, cmd); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: after init command failed: %s\n", err)
+	}
+}
+
+// runCommandLine runs a command line, either waiting for it to exit or
+// detached from the terminal. Any after init command runs once the delay has
+// passed, while emacs keeps running in either mode. Any pre-hook runs first,
+// and any post-hook runs once the command exits, unless it is detached.
+func runCommandLine(cmdLine []string, opts launchOptions) error {
+	if err := opts.runHook("pre", opts.preHook); err != nil {
+		return err
+	}
+	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
+	cmd.Env = opts.env()
+	cmd.Dir = opts.dir
+	if opts.detach {
+		if err := opts.runner.StartDetached(cmd); err != nil {
+			return err
+		}
+		opts.runAfterInit()
+		return nil
+	}
+
+	// Connect the standard streams so that terminal emacs has a TTY.
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Propagate the exit code of emacs so that scripts can tell its failures apart.
+	if err := opts.runner.Start(cmd); err != nil {
+		return err
+	}
+	opts.runAfterInit()
+	err := opts.runner.Wait(cmd)
+	if hookErr := opts.runHook("post", opts.postHook); err == nil {
+		err = hookErr
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return cli.Exit("", util.ExitCode(exitErr))
+	}
+	return err
+}
+
+// confirmRemoval asks the user to confirm a removal, unless it is confirmed
+// up front with the --yes flag or standard input is not a terminal.
+func confirmRemoval(c *cli.Context, prompt string) bool {
+	if c.Bool("yes") || !util.IsInteractive() {
+		return true
+	}
+	return util.Confirm(prompt)
+}
+
+// resolveContext returns the name of the environment context to use, preferring
+// the --context flag over the active context in the application state.
+func resolveContext(c *cli.Context, appState *state.State) (string, error) {
+	if c.String("context") != "" {
+		return c.String("context"), nil
+	}
+	if appState.Context != "" {
+		return appState.Context, nil
+	}
+	if appState.Default != "" {
+		return appState.Default, nil
+	}
+	return "", errors.NoContextError
+}
+
+// selectEnvironment returns the name of the environment to open and the files
+// to open in it. An environment provided with a leading @NAME argument or the
+// --env flag takes precedence over the environment context.
+func selectEnvironment(c *cli.Context, appState *state.State) (string, []string, error) {
+	files := c.Args().Slice()
+	var name string
+	if len(files) > 0 && strings.HasPrefix(files[0], "@") {
+		name = strings.TrimPrefix(files[0], "@")
+		files = files[1:]
+	}
+
+	// Ensure the environment is not selected in conflicting ways.
+	if env := c.String("env"); env != "" {
+		if name != "" && name != env {
+			return "", nil, errors.ConflictingEnvironmentError{First: "@" + name, Second: "--env " + env}
+		}
+		name = env
+	}
+	if name != "" && c.String("context") != "" && name != c.String("context") {
+		return "", nil, errors.ConflictingEnvironmentError{First: name, Second: "--context " + c.String("context")}
+	}
+	if name != "" {
+		return name, files, nil
+	}
+
+	// Otherwise, fall back to the environment context.
+	context, err := resolveContext(c, appState)
+	return context, files, err
+}
+
+// showAppVersion prints the version of the application.
+func showAppVersion(c *cli.Context) error {
+	fmt.Printf("%s version %s\n", config.AppName, config.AppVersion())
+	if !appConfig(c).Verbose {
+		return nil
+	}
+
+	buildInfo := util.GetBuildInfo()
 	if buildInfo == nil {
 		return nil
 	}
@@ -740,3 +4701,263 @@ func showAppVersion(_ *cli.Context) error {
 	}
 	return nil
 }
+
+// appInfo is the runtime information about the application printed by info.
+type appInfo struct {
+	Version      string            `json:"version"`
+	AppDir       string            `json:"app_dir"`
+	StatePath    string            `json:"state_path"`
+	CachePath    string            `json:"cache_path"`
+	Context      string            `json:"context,omitempty"`
+	EmacsPath    string            `json:"emacs_path,omitempty"`
+	EmacsVersion string            `json:"emacs_version,omitempty"`
+	Build        map[string]string `json:"build,omitempty"`
+}
+
+// completionShells lists the shells completion scripts can be printed for.
+var completionShells = []string{"bash", "zsh"}
+
+// completionScripts are the shell completion scripts by shell, which complete
+// by running the application with the --generate-bash-completion flag.
+var completionScripts = map[string]string{
+	"bash": `_emacsctl_complete() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  local words=("${COMP_WORDS[@]:0:COMP_CWORD}")
+  if [[ "$cur" == -* ]]; then
+    words+=("$cur")
+  fi
+  COMPREPLY=($(compgen -W "$("${words[@]}" --generate-bash-completion 2>/dev/null)" -- "$cur"))
+}
+complete -o bashdefault -o default -F _emacsctl_complete emacsctl
+`,
+	"zsh": `#compdef emacsctl
+_emacsctl_complete() {
+  local -a opts
+  local cur=${words[-1]}
+  if [[ "$cur" == -* ]]; then
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion 2>/dev/null)}")
+  else
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} --generate-bash-completion 2>/dev/null)}")
+  fi
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+compdef _emacsctl_complete emacsctl
+`,
+}
+
+// showCompletion prints the completion script of a shell.
+func showCompletion(c *cli.Context) error {
+	// Verify correct usage.
+	shell := c.String("shell")
+	script, ok := completionScripts[shell]
+	if !ok {
+		return errors.InvalidValueError{Name: "shell", Value: shell}
+	}
+
+	fmt.Print(script)
+	return nil
+}
+
+// environmentFlags are the names of the flags of commands completed by
+// completeEnvironmentFlags whose values are environment names.
+var environmentFlags = []string{"--context", "-c", "--env", "-e"}
+
+// completeEnvironmentFlags completes the value of the --context and --env
+// flags of a command with the names of the environments in the state file,
+// and completes its subcommands and flags like urfave/cli does otherwise.
+func completeEnvironmentFlags(c *cli.Context) {
+	// The argument being completed is not passed, so the previous one is
+	// last before the --generate-bash-completion flag.
+	if len(os.Args) < 3 || !slices.Contains(environmentFlags, os.Args[len(os.Args)-2]) {
+		cli.DefaultCompleteWithFlags(c.Command)(c)
+		return
+	}
+	appState := completionState(c)
+	if appState == nil {
+		return
+	}
+	names := make([]string, 0, len(appState.Environments))
+	for name := range appState.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(c.App.Writer, name)
+	}
+}
+
+// completionState loads the application state selected by the global flags
+// for completion, which runs without before. Unlike before, it changes nothing
+// on disk, and it returns nil on any failure so completion suggests nothing.
+func completionState(c *cli.Context) *state.State {
+	conf := &config.Config{
+		AppDir:    c.String("app-dir"),
+		StateFile: c.String("state-file"),
+		Global:    c.Bool("global"),
+	}
+	c.App.Metadata[configKey] = conf
+	if err := conf.ResolveAppDir(); err != nil {
+		return nil
+	}
+	if err := selectLocalState(c); err != nil {
+		return nil
+	}
+	if conf.AppDir == "" && conf.StateFile == "" {
+		return nil
+	}
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return nil
+	}
+	return appState
+}
+
+// aliasShells lists the shells alias definitions can be printed for.
+var aliasShells = []string{"bash", "zsh", "fish"}
+
+// showAliases prints shell function definitions opening each environment in
+// the state file by name, passing their arguments on to open.
+func showAliases(c *cli.Context) error {
+	// Verify correct usage.
+	shell := c.String("shell")
+	if !slices.Contains(aliasShells, shell) {
+		return errors.InvalidValueError{Name: "shell", Value: shell}
+	}
+
+	// Load the application state.
+	appState, err := loadState(appConfig(c).StatePath())
+	if err != nil {
+		return err
+	}
+
+	// Print a function for each environment, skipping those whose function
+	// would replace a shell builtin or the function of another environment.
+	names := make([]string, 0, len(appState.Environments))
+	for name := range appState.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	defined := make(map[string]string, len(names))
+	for _, name := range names {
+		alias := aliasName(name)
+		if slices.Contains(reservedAliasNames, alias) {
+			fmt.Fprintf(os.Stderr, "warning: not defining function %s of environment %s, a shell keyword or builtin\n", alias, name)
+			continue
+		}
+		if other, ok := defined[alias]; ok {
+			fmt.Fprintf(os.Stderr, "warning: not defining function %s of environment %s, already that of environment %s\n", alias, name, other)
+			continue
+		}
+		defined[alias] = name
+		fmt.Println(aliasDefinition(shell, name))
+	}
+	return nil
+}
+
+// reservedAliasNames lists the keywords and builtins of the alias shells that
+// environment functions must not replace.
+var reservedAliasNames = []string{
+	"abbr", "alias", "and", "argparse", "autoload", "begin", "bg", "bind", "bindkey",
+	"break", "builtin", "caller", "case", "cd", "command", "compgen", "complete",
+	"compopt", "contains", "continue", "count", "declare", "dirs", "disown", "do",
+	"done", "echo", "elif", "else", "emit", "emulate", "enable", "end", "esac", "eval",
+	"exec", "exit", "export", "false", "fc", "fg", "fi", "for", "foreach", "function",
+	"functions", "getopts", "hash", "help", "history", "if", "in", "integer", "jobs",
+	"kill", "let", "local", "logout", "mapfile", "math", "noglob", "not", "or",
+	"popd", "print", "printf", "pushd", "pwd", "read", "readarray", "readonly",
+	"repeat", "return", "select", "set", "setopt", "shift", "shopt", "source",
+	"status", "string", "suspend", "switch", "test", "then", "time", "times", "trap",
+	"true", "type", "typeset", "ulimit", "umask", "unalias", "unset", "unsetopt",
+	"until", "wait", "whence", "where", "which", "while",
+}
+
+// aliasDefinition returns the definition of a shell function opening an
+// environment, named after the environment sanitized to a shell identifier.
+func aliasDefinition(shell, name string) string {
+	openLine := config.AppName + " open --env " + shellwords.Quote(name)
+	if shell == "fish" {
+		return fmt.Sprintf("function %s; %s $argv; end", aliasName(name), openLine)
+	}
+	return fmt.Sprintf("%s() { %s \"$@\"; }", aliasName(name), openLine)
+}
+
+// aliasName sanitizes an environment name to a valid shell identifier by
+// replacing invalid characters with underscores, and prefixing one if it
+// would otherwise start with a digit.
+func aliasName(name string) string {
+	alias := []rune(name)
+	for i, r := range alias {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			alias[i] = '_'
+		}
+	}
+	if len(alias) == 0 || alias[0] >= '0' && alias[0] <= '9' {
+		return "_" + string(alias)
+	}
+	return string(alias)
+}
+
+// showAppInfo prints the version of the application, its resolved paths, the
+// environment context, and the emacs binary it uses.
+func showAppInfo(c *cli.Context) error {
+	conf := appConfig(c)
+
+	info := appInfo{
+		Version:   config.AppVersion(),
+		AppDir:    conf.AppDir,
+		StatePath: conf.StatePath(),
+		CachePath: conf.CachePath(),
+		Build:     util.GetBuildInfo(),
+	}
+
+	// Find the emacs binary of the context, falling back to any detected one.
+	appState, err := loadState(conf.StatePath())
+	if err != nil {
+		return err
+	}
+	if context, err := resolveContext(c, appState); err == nil {
+		info.Context = context
+		if env, err := appState.Resolve(context); err == nil {
+			if path, err := exec.LookPath(env.Command.BinPath); err == nil {
+				info.EmacsPath = path
+			}
+		}
+	}
+	if info.EmacsPath == "" {
+		if installs := util.DetectEmacsBinaries(runWith(appRunner(c))); len(installs) > 0 {
+			info.EmacsPath = installs[0].Path
+		}
+	}
+	if info.EmacsPath != "" {
+		info.EmacsVersion = util.EmacsVersion(runWith(appRunner(c)), info.EmacsPath)
+	}
+
+	// Print the information in the requested format.
+	switch output := c.String("output"); output {
+	case "json":
+		return printJSON(info)
+	case "text":
+		fmt.Printf("version:       %s\n", info.Version)
+		fmt.Printf("app dir:       %s\n", info.AppDir)
+		fmt.Printf("state path:    %s\n", info.StatePath)
+		fmt.Printf("cache path:    %s\n", info.CachePath)
+		fmt.Printf("context:       %s\n", valueOrNone(info.Context))
+		fmt.Printf("emacs path:    %s\n", valueOrNone(info.EmacsPath))
+		fmt.Printf("emacs version: %s\n", valueOrNone(info.EmacsVersion))
+		keys := make([]string, 0, len(info.Build))
+		for key := range info.Build {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%-15s%s\n", key+":", info.Build[key])
+		}
+		return nil
+	default:
+		return errors.InvalidValueError{Name: "output", Value: output}
+	}
+}
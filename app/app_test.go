@@ -0,0 +1,1006 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/mojochao/emacsctl/archive"
+	"github.com/mojochao/emacsctl/config"
+	"github.com/mojochao/emacsctl/errors"
+	"github.com/mojochao/emacsctl/state"
+)
+
+// testEnv is a home, application, and cache directory isolated from the user's own.
+type testEnv struct {
+	t       *testing.T
+	home    string
+	appDir  string
+	runner  Runner
+	cacheTo string
+}
+
+// fakeRunner is a Runner recording the command lines it is asked to run
+// instead of running them.
+type fakeRunner struct {
+	// started are the command lines started, detached or not.
+	started [][]string
+	// detached are the command lines started detached.
+	detached [][]string
+	// wait returns the result of waiting for a command, which succeeds if nil.
+	wait func(cmd *exec.Cmd) error
+}
+
+func (r *fakeRunner) Start(cmd *exec.Cmd) error {
+	r.started = append(r.started, cmd.Args)
+	return nil
+}
+
+func (r *fakeRunner) Wait(cmd *exec.Cmd) error {
+	if r.wait == nil {
+		return nil
+	}
+	return r.wait(cmd)
+}
+
+func (r *fakeRunner) StartDetached(cmd *exec.Cmd) error {
+	r.started = append(r.started, cmd.Args)
+	r.detached = append(r.detached, cmd.Args)
+	return nil
+}
+
+// commandLines returns command lines joined with spaces.
+func commandLines(argvs [][]string) []string {
+	lines := make([]string, len(argvs))
+	for i, argv := range argvs {
+		lines[i] = strings.Join(argv, " ")
+	}
+	return lines
+}
+
+// newTestEnv creates a testEnv in temporary directories.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("NO_COLOR", "1")
+	for _, name := range []string{"EMACSCTL_DIR", "EMACSCFG_DIR", "EMACSCTL_STATE_FILE", "EMACSCTL_CACHE_DIR", "EMACSCTL_LOG_LEVEL"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	// Flags read from environment variables keep their values across runs, so
+	// restore them for the next test.
+	flags := []*cli.StringFlag{&appDirFlag, &stateFileFlag, &cacheDirFlag, &logLevelFlag}
+	saved := make([]cli.StringFlag, len(flags))
+	for i, flag := range flags {
+		saved[i] = *flag
+	}
+	t.Cleanup(func() {
+		for i, flag := range flags {
+			*flag = saved[i]
+		}
+	})
+	return &testEnv{
+		t:       t,
+		home:    home,
+		appDir:  filepath.Join(home, "app"),
+		cacheTo: filepath.Join(home, "cache"),
+	}
+}
+
+// run runs the application with args after the global flags selecting the
+// environment's directories, returning what it wrote to stdout.
+func (e *testEnv) run(args ...string) (string, error) {
+	e.t.Helper()
+	return e.runArgs(append([]string{"--global", "--app-dir", e.appDir, "--cache-dir", e.cacheTo}, args...)...)
+}
+
+// runArgs runs the application with args only, returning what it wrote to stdout.
+func (e *testEnv) runArgs(args ...string) (string, error) {
+	e.t.Helper()
+	a := New()
+	if e.runner != nil {
+		SetRunner(a, e.runner)
+	}
+	// Return exit codes as errors rather than exiting the test binary.
+	a.ExitErrHandler = func(*cli.Context, error) {}
+	argv := append([]string{"emacsctl"}, args...)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+	err = a.Run(argv)
+	os.Stdout = stdout
+	_ = w.Close()
+	return <-done, err
+}
+
+// mustRun runs the application like run, failing the test on any error.
+func (e *testEnv) mustRun(args ...string) string {
+	e.t.Helper()
+	out, err := e.run(args...)
+	if err != nil {
+		e.t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+// state loads the state file written to the application directory.
+func (e *testEnv) state() *state.State {
+	e.t.Helper()
+	data, err := os.ReadFile(filepath.Join(e.appDir, "state.json"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	var s state.State
+	if err := json.Unmarshal(data, &s); err != nil {
+		e.t.Fatal(err)
+	}
+	return &s
+}
+
+func TestEndToEnd(t *testing.T) {
+	e := newTestEnv(t)
+	initDir := filepath.Join(e.home, "vanilla")
+	if err := os.Mkdir(initDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	e.mustRun("command", "add", "--no-verify", "emacs29", "/opt/emacs29/bin/emacs", "-nw")
+	e.mustRun("config", "add", "vanilla", initDir)
+	e.mustRun("environment", "add", "--cmd", "emacs29", "--cfg", "vanilla", "dev")
+	e.mustRun("context", "set", "dev")
+
+	s := e.state()
+	cmd, ok := s.Commands["emacs29"]
+	if !ok {
+		t.Fatalf("command emacs29 not in state: %v", s.Commands)
+	}
+	if cmd.BinPath != "/opt/emacs29/bin/emacs" || strings.Join(cmd.BinArgs, " ") != "-nw" {
+		t.Errorf("command emacs29 = %s %v, want /opt/emacs29/bin/emacs [-nw]", cmd.BinPath, cmd.BinArgs)
+	}
+	if cmd.CreatedAt == "" {
+		t.Error("command emacs29 has no creation time")
+	}
+	if cfg, ok := s.Configs["vanilla"]; !ok || cfg.InitDir != initDir {
+		t.Errorf("config vanilla = %+v, want init dir %s", cfg, initDir)
+	}
+	if env, ok := s.Environments["dev"]; !ok || env.CommandName != "emacs29" || env.ConfigName != "vanilla" {
+		t.Errorf("environment dev = %+v, want emacs29 and vanilla", env)
+	}
+	if s.Context != "dev" {
+		t.Errorf("context = %q, want dev", s.Context)
+	}
+
+	out := e.mustRun("--dry-run", "open", "foo.txt")
+	want := "/opt/emacs29/bin/emacs -nw --init-directory " + initDir + " foo.txt"
+	if !strings.Contains(out, want) {
+		t.Errorf("open --dry-run printed %q, want it to contain %q", out, want)
+	}
+
+	out = e.mustRun("--dry-run", "open", "@default", "bar.txt")
+	if !strings.Contains(out, "\nemacs --init-directory ") || !strings.HasSuffix(out, " bar.txt\n") {
+		t.Errorf("open --dry-run @default printed %q, want the default command line", out)
+	}
+	if got := e.state().Context; got != "dev" {
+		t.Errorf("context after open @default = %q, want dev", got)
+	}
+}
+
+func TestAddCommandExists(t *testing.T) {
+	e := newTestEnv(t)
+	e.mustRun("command", "add", "--no-verify", "emacs29", "/opt/emacs29/bin/emacs")
+	if _, err := e.run("command", "add", "--no-verify", "emacs29", "/opt/emacs30/bin/emacs"); err == nil {
+		t.Fatal("adding a command twice succeeded")
+	}
+	if got := e.state().Commands["emacs29"].BinPath; got != "/opt/emacs29/bin/emacs" {
+		t.Errorf("bin path = %q after failed add, want it unchanged", got)
+	}
+}
+
+func TestContextSetUnknown(t *testing.T) {
+	e := newTestEnv(t)
+	e.mustRun("context", "set", "default")
+	if _, err := e.run("context", "set", "nope"); err == nil {
+		t.Fatal("setting an unknown context succeeded")
+	}
+	if got := e.state().Context; got != "default" {
+		t.Errorf("context = %q, want default", got)
+	}
+}
+
+func TestImportArchiveHostileInitDir(t *testing.T) {
+	e := newTestEnv(t)
+	e.mustRun("context", "set", "default")
+	victim := filepath.Join(e.appDir, "victim")
+	if err := os.Mkdir(victim, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, initDir := range []string{"configs/../../victim", "configs/x/../../../victim", "configs/a/b"} {
+		data, err := json.Marshal(map[string]any{
+			"version": state.CurrentVersion,
+			"configs": map[string]any{"evil": map[string]any{"init_dir": initDir}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		archivePath := filepath.Join(e.home, "evil.tar.gz")
+		if err := archive.Write(archivePath, data, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = e.run("state", "import", "--archive", archivePath)
+		if !stderrors.As(err, new(errors.UnsafeArchiveEntryError)) {
+			t.Errorf("import of init dir %s: err = %v, want UnsafeArchiveEntryError", initDir, err)
+		}
+		if _, err := os.Stat(victim); err != nil {
+			t.Errorf("import of init dir %s moved %s: %v", initDir, victim, err)
+		}
+		if e.state().ConfigExists("evil") {
+			t.Errorf("import of init dir %s added config evil", initDir)
+		}
+	}
+}
+
+func TestLockReleased(t *testing.T) {
+	e := newTestEnv(t)
+	statePath := filepath.Join(e.appDir, "state.json")
+	assertUnlocked := func(after string) {
+		t.Helper()
+		unlock, err := state.Lock(statePath, 0)
+		if err != nil {
+			t.Errorf("lock held after %s: %v", after, err)
+			return
+		}
+		_ = unlock()
+	}
+	e.mustRun("command", "add", "--no-verify", "emacs29", "/opt/emacs29/bin/emacs")
+	assertUnlocked("command")
+	if _, err := e.run("command", "add", "--no-verify", "emacs29", "/opt/emacs29/bin/emacs"); err == nil {
+		t.Fatal("adding a command twice succeeded")
+	}
+	assertUnlocked("failed command")
+}
+
+// newRunnerEnv creates a testEnv with a fake runner and an environment dev
+// using the command line /opt/emacs29/bin/emacs -nw as its context.
+func newRunnerEnv(t *testing.T) (*testEnv, *fakeRunner) {
+	t.Helper()
+	e := newTestEnv(t)
+	runner := &fakeRunner{}
+	e.runner = runner
+	initDir := filepath.Join(e.home, "vanilla")
+	if err := os.Mkdir(initDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun("command", "add", "--no-verify", "emacs29", "/opt/emacs29/bin/emacs", "-nw")
+	e.mustRun("config", "add", "vanilla", initDir)
+	e.mustRun("environment", "add", "--cmd", "emacs29", "--cfg", "vanilla", "dev")
+	e.mustRun("context", "set", "dev")
+	runner.started = nil
+	return e, runner
+}
+
+func TestRunnerOpen(t *testing.T) {
+	e, runner := newRunnerEnv(t)
+	e.mustRun("open", "--after-init", "notify-send 'emacs started'", "--after-init-delay", "0s", "foo.txt")
+
+	initDir := filepath.Join(e.home, "vanilla")
+	want := [][]string{
+		{"/opt/emacs29/bin/emacs", "-nw", "--init-directory", initDir, "foo.txt"},
+		{"notify-send", "emacs started"},
+	}
+	if !reflect.DeepEqual(runner.started, want) {
+		t.Errorf("started %q, want %q", runner.started, want)
+	}
+}
+
+func TestRunnerOpenReuse(t *testing.T) {
+	initDir := func(e *testEnv) string { return filepath.Join(e.home, "vanilla") }
+	tests := []struct {
+		name    string
+		running bool
+		want    func(e *testEnv) []string
+	}{
+		{"running", true, func(e *testEnv) []string {
+			return []string{"/opt/emacs29/bin/emacsclient --no-wait --socket-name dev --create-frame foo.txt"}
+		}},
+		{"not running", false, func(e *testEnv) []string {
+			return []string{"/opt/emacs29/bin/emacs -nw --init-directory " + initDir(e) + " foo.txt"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, runner := newRunnerEnv(t)
+			runner.wait = func(cmd *exec.Cmd) error {
+				if slices.Contains(cmd.Args, "--eval") && !tt.running {
+					return &exec.ExitError{}
+				}
+				return nil
+			}
+			e.mustRun("open", "--reuse", "foo.txt")
+
+			want := append([]string{"/opt/emacs29/bin/emacsclient --socket-name dev --eval t"}, tt.want(e)...)
+			if got := commandLines(runner.started); !reflect.DeepEqual(got, want) {
+				t.Errorf("started %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRunnerCommandTest(t *testing.T) {
+	e, runner := newRunnerEnv(t)
+	runner.wait = func(cmd *exec.Cmd) error {
+		_, err := io.WriteString(cmd.Stdout, "GNU Emacs 29.1\nCopyright (C) 2023\n")
+		return err
+	}
+	out := e.mustRun("command", "test", "emacs29")
+
+	want := []string{"/opt/emacs29/bin/emacs -nw --version"}
+	if got := commandLines(runner.started); !reflect.DeepEqual(got, want) {
+		t.Errorf("started %q, want %q", got, want)
+	}
+	if out != "emacs29: ok: GNU Emacs 29.1\n" {
+		t.Errorf("printed %q, want the version", out)
+	}
+}
+
+func TestRunnerVerifyEmacs(t *testing.T) {
+	e := newTestEnv(t)
+	runner := &fakeRunner{wait: func(cmd *exec.Cmd) error {
+		_, err := io.WriteString(cmd.Stdout, "GNU Emacs 30.1\n")
+		return err
+	}}
+	e.runner = runner
+	binPath := filepath.Join(e.home, "emacs")
+	if err := os.WriteFile(binPath, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun("command", "add", "emacs30", binPath)
+
+	want := []string{binPath + " --version"}
+	if got := commandLines(runner.started); !reflect.DeepEqual(got, want) {
+		t.Errorf("started %q, want %q", got, want)
+	}
+	if got := e.state().Commands["emacs30"].Version; got != "GNU Emacs 30.1" {
+		t.Errorf("version = %q, want GNU Emacs 30.1", got)
+	}
+}
+
+func TestAddConfigPostCheckout(t *testing.T) {
+	e := newTestEnv(t)
+	e.mustRun("config", "add", "--no-cache", "--post-checkout", `sh -c 'make compile' "two words"`, "remote", "https://example.com/emacs.d.git")
+	want := []string{"sh", "-c", "make compile", "two words"}
+	if got := e.state().Configs["remote"].PostCheckout; !reflect.DeepEqual(got, want) {
+		t.Errorf("post-checkout = %q, want %q", got, want)
+	}
+
+	_, err := e.run("config", "add", "--no-cache", "--post-checkout", "sh -c 'make", "broken", "https://example.com/emacs.d.git")
+	if !stderrors.As(err, new(errors.InvalidCommandLineError)) {
+		t.Errorf("err = %v, want InvalidCommandLineError", err)
+	}
+	if e.state().ConfigExists("broken") {
+		t.Error("config with invalid post-checkout command line added")
+	}
+}
+
+func TestOpenInvalidAfterInit(t *testing.T) {
+	e, runner := newRunnerEnv(t)
+	_, err := e.run("open", "--after-init", "notify-send 'emacs started", "foo.txt")
+	if !stderrors.As(err, new(errors.InvalidCommandLineError)) {
+		t.Errorf("err = %v, want InvalidCommandLineError", err)
+	}
+	if len(runner.started) > 0 {
+		t.Errorf("started %q, want nothing", runner.started)
+	}
+}
+
+func TestEditStateEditor(t *testing.T) {
+	e := newTestEnv(t)
+	runner := &fakeRunner{}
+	e.runner = runner
+	t.Setenv("EDITOR", `"/opt/my editor/bin/edit" --wait`)
+	e.mustRun("state", "edit")
+
+	want := [][]string{{"/opt/my editor/bin/edit", "--wait", filepath.Join(e.appDir, "state.json")}}
+	if !reflect.DeepEqual(runner.started, want) {
+		t.Errorf("started %q, want %q", runner.started, want)
+	}
+
+	t.Setenv("EDITOR", `"/opt/my editor/bin/edit`)
+	if _, err := e.run("state", "edit"); !stderrors.As(err, new(errors.InvalidCommandLineError)) {
+		t.Errorf("err = %v, want InvalidCommandLineError", err)
+	}
+}
+
+// gitRemoteURL is the URL of the git repositories created by newGitRemote.
+const gitRemoteURL = "https://git.example.com/"
+
+// newGitRemote creates a git repository with a single commit in the home
+// directory of a testEnv, and returns its URL, rewritten to the repository by
+// the git config of the home directory.
+func newGitRemote(t *testing.T, e *testEnv, name string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	gitConfig := fmt.Sprintf("[url \"file://%s/\"]\n\tinsteadOf = %s\n", e.home, gitRemoteURL)
+	if err := os.WriteFile(filepath.Join(e.home, ".gitconfig"), []byte(gitConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(e.home, name)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "init.el"), []byte("(setq inhibit-startup-screen t)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "init.el"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, output)
+		}
+	}
+	return gitRemoteURL + name
+}
+
+func TestConfigStatus(t *testing.T) {
+	e := newTestEnv(t)
+	url := newGitRemote(t, e, "remote")
+	localDir := filepath.Join(e.home, "local")
+	if err := os.Mkdir(localDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun("config", "add", "local", localDir)
+	e.mustRun("config", "add", "cloned", url)
+	e.mustRun("config", "add", "--no-cache", "unfetched", url)
+	e.mustRun("config", "add", "--no-cache", "--source", localDir, "--source", url, "composed")
+
+	out := e.mustRun("config", "status", "--offline", "--format", "{{.Name}} {{.Status}}", "cloned", "composed", "local", "unfetched")
+	want := "cloned up to date\ncomposed unfetched\nlocal local\nunfetched unfetched\n"
+	if out != want {
+		t.Errorf("config status printed %q, want %q", out, want)
+	}
+
+	e.mustRun("config", "fetch", "composed")
+	out = e.mustRun("config", "status", "--offline", "--format", "{{.Name}} {{.Status}}", "composed")
+	if out != "composed up to date\n" {
+		t.Errorf("config status of fetched composed config printed %q, want up to date", out)
+	}
+}
+
+func TestShowEnvironmentGitBacked(t *testing.T) {
+	e := newTestEnv(t)
+	url := newGitRemote(t, e, "remote")
+	localDir := filepath.Join(e.home, "local")
+	if err := os.Mkdir(localDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun("command", "add", "--no-verify", "emacs", "emacs")
+	e.mustRun("config", "add", "local", localDir)
+	e.mustRun("config", "add", "cloned", url)
+	e.mustRun("config", "add", "--no-cache", "unfetched", url)
+	e.mustRun("config", "add", "--source", localDir, "--source", url, "composed")
+
+	tests := []struct {
+		config    string
+		gitBacked bool
+		cached    bool
+	}{
+		{"local", false, false},
+		{"cloned", true, true},
+		{"unfetched", true, false},
+		{"composed", true, true},
+	}
+	for _, tt := range tests {
+		e.mustRun("environment", "add", "--cmd", "emacs", "--cfg", tt.config, tt.config)
+		var details struct {
+			GitBacked bool `json:"git_backed"`
+			Cached    bool `json:"cached"`
+		}
+		if err := json.Unmarshal([]byte(e.mustRun("environment", "show", "--output", "json", tt.config)), &details); err != nil {
+			t.Fatal(err)
+		}
+		if details.GitBacked != tt.gitBacked || details.Cached != tt.cached {
+			t.Errorf("environment %s: git backed %t, cached %t, want %t, %t", tt.config, details.GitBacked, details.Cached, tt.gitBacked, tt.cached)
+		}
+	}
+}
+
+func TestAppDirEnvVars(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ map[string]string
+		want    string
+	}{
+		{"EMACSCTL_DIR", map[string]string{"EMACSCTL_DIR": "current"}, "current"},
+		{"EMACSCFG_DIR", map[string]string{"EMACSCFG_DIR": "legacy"}, "legacy"},
+		{"both", map[string]string{"EMACSCTL_DIR": "current", "EMACSCFG_DIR": "legacy"}, "current"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			for name, dir := range tt.environ {
+				t.Setenv(name, filepath.Join(e.home, dir))
+			}
+			out, err := e.runArgs("--global", "state", "path")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(e.home, tt.want, "state.json") + "\n"; out != want {
+				t.Errorf("state path = %q, want %q", out, want)
+			}
+		})
+	}
+}
+
+func TestNoHomeDir(t *testing.T) {
+	// The default directories are resolved when the packages are initialized,
+	// so the application runs in a test binary started without HOME.
+	if os.Getenv("EMACSCTL_TEST_NO_HOME") != "" {
+		err := New().Run(append([]string{"emacsctl", "--global"}, strings.Fields(os.Getenv("EMACSCTL_TEST_NO_HOME"))...))
+		if stderrors.Is(err, errors.NoHomeDirError) {
+			os.Exit(3)
+		}
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	tests := []struct {
+		name string
+		args string
+		want int
+	}{
+		{"default app dir", "state path", 3},
+		{"app dir flag", "--app-dir " + t.TempDir() + " state path", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestNoHomeDir$")
+			for _, variable := range os.Environ() {
+				if !strings.HasPrefix(variable, "HOME=") && !strings.HasPrefix(variable, "EMACSCTL_") {
+					cmd.Env = append(cmd.Env, variable)
+				}
+			}
+			cmd.Env = append(cmd.Env, "EMACSCTL_TEST_NO_HOME="+tt.args)
+			err := cmd.Run()
+			code := 0
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.want {
+				t.Errorf("exit code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenDetach(t *testing.T) {
+	e, runner := newRunnerEnv(t)
+	e.mustRun("open", "--detach", "--after-init", "notify-send started", "--after-init-delay", "0s", "foo.txt")
+
+	emacsLine := "/opt/emacs29/bin/emacs -nw --init-directory " + filepath.Join(e.home, "vanilla") + " foo.txt"
+	if got, want := commandLines(runner.detached), []string{emacsLine}; !reflect.DeepEqual(got, want) {
+		t.Errorf("detached %q, want %q", got, want)
+	}
+	if got, want := commandLines(runner.started), []string{emacsLine, "notify-send started"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("started %q, want %q", got, want)
+	}
+}
+
+func TestOpenStandardStreams(t *testing.T) {
+	e := newTestEnv(t)
+	script := filepath.Join(e.home, "echo-emacs")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexec cat -\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun("command", "add", "--no-verify", "echo", script)
+	e.mustRun("config", "add", "home", e.home)
+	e.mustRun("environment", "add", "--cmd", "echo", "--cfg", "home", "echo")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello from stdin\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	out := e.mustRun("open", "@echo", "foo.txt")
+	if out != "hello from stdin\n" {
+		t.Errorf("emacs printed %q, want what was written to stdin", out)
+	}
+}
+
+func TestListSortOrder(t *testing.T) {
+	e := newTestEnv(t)
+	for _, command := range [][]string{
+		{"zeta", "1: first by description"},
+		{"alpha", "3: last by description"},
+		{"mu", "2: middle by description"},
+		{"beta", "2: middle by description"},
+	} {
+		e.mustRun("command", "add", "--no-verify", "--desc", command[1], command[0], "emacs")
+		e.mustRun("config", "add", "--desc", command[1], command[0], e.home)
+		e.mustRun("environment", "add", "--cmd", command[0], "--cfg", command[0], "--desc", command[1], command[0])
+	}
+
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"name", "alpha\nbeta\ndefault\nmu\nzeta\n"},
+		{"description", "zeta\nbeta\nmu\nalpha\ndefault\n"},
+	}
+	for _, kind := range []string{"command", "config", "environment"} {
+		for _, tt := range tests {
+			for i := 0; i < 5; i++ {
+				out := e.mustRun(kind, "list", "--output", "names", "--sort", tt.sort)
+				if out != tt.want {
+					t.Fatalf("%s list --sort %s printed %q, want %q", kind, tt.sort, out, tt.want)
+				}
+			}
+		}
+		if _, err := e.run(kind, "list", "--sort", "size"); !stderrors.As(err, new(errors.InvalidValueError)) {
+			t.Errorf("%s list --sort size: err = %v, want InvalidValueError", kind, err)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	version := config.Version
+	t.Cleanup(func() { config.Version = version })
+
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"", "emacsctl version dev\n"},
+		{"1.2.3", "emacsctl version 1.2.3\n"},
+	}
+	for _, tt := range tests {
+		config.Version = tt.version
+		e := newTestEnv(t)
+		if out := e.mustRun("version"); out != tt.want {
+			t.Errorf("version %q printed %q, want %q", tt.version, out, tt.want)
+		}
+		if out := e.mustRun("--verbose", "version"); !strings.HasPrefix(out, tt.want) {
+			t.Errorf("verbose version %q printed %q, want it to start with %q", tt.version, out, tt.want)
+		}
+	}
+}
+
+func TestLocalState(t *testing.T) {
+	e := newTestEnv(t)
+	project := filepath.Join(e.home, "project")
+	nested := filepath.Join(project, "src")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(cwd) })
+	// Only the paths of the global state are printed, never its content.
+	globalPath := filepath.Join(config.DefaultAppDir, "state.json") + "\n"
+	localPath := config.LocalStatePath(project) + "\n"
+
+	if err := os.Chdir(project); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := e.runArgs("state", "path"); out != globalPath {
+		t.Errorf("state path without local state = %q, want %q", out, globalPath)
+	}
+	if _, err := e.runArgs("--local", "context", "set", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(config.LocalStatePath(project)); err != nil {
+		t.Errorf("--local did not create the local state: %v", err)
+	}
+
+	if err := os.Chdir(nested); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := e.runArgs("state", "path"); out != localPath {
+		t.Errorf("state path in nested dir = %q, want %q", out, localPath)
+	}
+	if out, _ := e.runArgs("--global", "state", "path"); out != globalPath {
+		t.Errorf("state path with --global = %q, want %q", out, globalPath)
+	}
+	if _, err := e.runArgs("--local", "--global", "state", "path"); !stderrors.As(err, new(errors.ConflictingFlagsError)) {
+		t.Errorf("--local with --global: err = %v, want ConflictingFlagsError", err)
+	}
+}
+
+func TestInitTimestamps(t *testing.T) {
+	e := newTestEnv(t)
+	e.mustRun("init", "--emacs-path", "/opt/emacs29/bin/emacs", "--config-dir", e.home, "--no-verify")
+
+	s := e.state()
+	if got := s.Commands["default"].BinPath; got != "/opt/emacs29/bin/emacs" {
+		t.Errorf("default bin path = %q, want /opt/emacs29/bin/emacs", got)
+	}
+	if got := s.Configs["default"].InitDir; got != e.home {
+		t.Errorf("default init dir = %q, want %q", got, e.home)
+	}
+	if s.Commands["default"].CreatedAt == "" || s.Configs["default"].CreatedAt == "" || s.Environments["default"].CreatedAt == "" {
+		t.Errorf("default entities initialized without creation times: %+v", s)
+	}
+}
+
+func TestOpenExitCode(t *testing.T) {
+	tests := []struct {
+		script string
+		want   int
+	}{
+		{"exit 3", 3},
+		{"kill -TERM $$", 143},
+	}
+	for _, tt := range tests {
+		e := newTestEnv(t)
+		script := filepath.Join(e.home, "emacs")
+		if err := os.WriteFile(script, []byte("#!/bin/sh\n"+tt.script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		e.mustRun("command", "add", "--no-verify", "script", script)
+		e.mustRun("config", "add", "home", e.home)
+		e.mustRun("environment", "add", "--cmd", "script", "--cfg", "home", "script")
+
+		_, err := e.run("open", "@script")
+		var exitErr cli.ExitCoder
+		if !stderrors.As(err, &exitErr) || exitErr.ExitCode() != tt.want {
+			t.Errorf("%s: err = %v, want exit code %d", tt.script, err, tt.want)
+		}
+	}
+}
+
+func TestAddConfigCleanup(t *testing.T) {
+	e := newTestEnv(t)
+	url := newGitRemote(t, e, "remote")
+	e.mustRun("config", "add", "existing", e.home)
+
+	// cacheEntries returns the names of the entries of the cache directory.
+	cacheEntries := func() []string {
+		entries, err := os.ReadDir(e.cacheTo)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	if _, err := e.run("config", "add", "existing", url); !stderrors.As(err, new(errors.ConfigExistsError)) {
+		t.Errorf("adding existing config: err = %v, want ConfigExistsError", err)
+	}
+	if names := cacheEntries(); len(names) > 0 {
+		t.Errorf("adding existing config cloned %q", names)
+	}
+
+	if _, err := e.run("config", "add", "--trust", "--post-checkout", "false", "failing", url); err == nil {
+		t.Error("adding config with failing post-checkout command succeeded")
+	}
+	if _, err := e.run("config", "add", "--trust", "--post-checkout", "false", "--source", e.home, "--source", url, "composed"); err == nil {
+		t.Error("adding composed config with failing post-checkout command succeeded")
+	}
+	if names := cacheEntries(); len(names) > 0 {
+		t.Errorf("failed adds left %q in the cache", names)
+	}
+	if _, err := os.Stat(filepath.Join(e.appDir, "composed", "composed")); !os.IsNotExist(err) {
+		t.Errorf("failed add left composed directory: %v", err)
+	}
+	s := e.state()
+	if s.ConfigExists("failing") || s.ConfigExists("composed") {
+		t.Error("failed adds added configs")
+	}
+
+	e.mustRun("config", "add", "--trust", "--post-checkout", "true", "cloned", url)
+	if names := cacheEntries(); !slices.Equal(names, []string{"cloned"}) {
+		t.Errorf("cache = %q after successful add, want [cloned]", names)
+	}
+}
+
+func TestOpenConfigEnvironmentFlags(t *testing.T) {
+	e, runner := newRunnerEnv(t)
+	initDir := filepath.Join(e.home, "vanilla")
+
+	if _, err := e.run("config", "open", "--env", "dev", "--context", "default", "vanilla"); !stderrors.As(err, new(errors.ConflictingFlagsError)) {
+		t.Errorf("--env with --context: err = %v, want ConflictingFlagsError", err)
+	}
+	if len(runner.started) > 0 {
+		t.Errorf("started %q with conflicting flags, want nothing", runner.started)
+	}
+
+	e.mustRun("config", "open", "--env", "dev", "vanilla")
+	e.mustRun("config", "open", "--context", "dev", "vanilla")
+	want := "/opt/emacs29/bin/emacs -nw --init-directory " + initDir + " " + initDir
+	if got := commandLines(runner.started); !reflect.DeepEqual(got, []string{want, want}) {
+		t.Errorf("started %q, want %q twice", got, want)
+	}
+}
+
+func TestRemoveWithoutTerminal(t *testing.T) {
+	e, _ := newRunnerEnv(t)
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	stdin := os.Stdin
+	os.Stdin = devNull
+	defer func() { os.Stdin = stdin }()
+
+	out := e.mustRun("environment", "remove", "dev")
+	if strings.Contains(out, "[y/N]") {
+		t.Errorf("remove printed %q, want no prompt", out)
+	}
+	if _, ok := e.state().Environments["dev"]; ok {
+		t.Error("environment dev not removed")
+	}
+}
+
+func TestAliasesSkipped(t *testing.T) {
+	e, _ := newRunnerEnv(t)
+	for _, name := range []string{"my-env", "my_env", "test", "cd"} {
+		e.mustRun("environment", "add", "--cmd", "emacs29", "--cfg", "vanilla", name)
+	}
+
+	out := e.mustRun("alias")
+	want := []string{
+		`default() { emacsctl open --env default "$@"; }`,
+		`dev() { emacsctl open --env dev "$@"; }`,
+		`my_env() { emacsctl open --env my-env "$@"; }`,
+	}
+	if got := strings.Split(strings.TrimSuffix(out, "\n"), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("alias printed %q, want %q", got, want)
+	}
+}
+
+func TestOpenConfigUnavailable(t *testing.T) {
+	e, runner := newRunnerEnv(t)
+	e.mustRun("config", "add", "--no-cache", "remote", "https://git.example.com/remote.git")
+	gone := filepath.Join(e.home, "gone")
+	if err := os.Mkdir(gone, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e.mustRun("config", "add", "gone", gone)
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.run("config", "open", "remote"); !stderrors.As(err, new(errors.ConfigNotFetchedError)) {
+		t.Errorf("unfetched config: err = %v, want ConfigNotFetchedError", err)
+	}
+	if _, err := e.run("config", "open", "gone"); !stderrors.As(err, new(errors.InitDirNotFoundError)) {
+		t.Errorf("missing init dir: err = %v, want InitDirNotFoundError", err)
+	}
+	e.mustRun("environment", "add", "--cmd", "emacs29", "--cfg", "gone", "broken")
+	if _, err := e.run("config", "open", "--env", "broken", "vanilla"); !stderrors.As(err, new(errors.InitDirNotFoundError)) {
+		t.Errorf("missing init dir of the environment: err = %v, want InitDirNotFoundError", err)
+	}
+	if len(runner.started) > 0 {
+		t.Errorf("started %q, want nothing", runner.started)
+	}
+}
+
+func TestEnvironmentPathsAbsolute(t *testing.T) {
+	e, _ := newRunnerEnv(t)
+	project := filepath.Join(e.home, "project")
+	if err := os.Mkdir(project, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(cwd) })
+	if err := os.Chdir(project); err != nil {
+		t.Fatal(err)
+	}
+
+	e.mustRun("environment", "add", "--cmd", "emacs29", "--cfg", "vanilla", "--working-dir", "./src", "--env-file", "~/.env", "proj")
+	env := e.state().Environments["proj"]
+	if want := filepath.Join(project, "src"); env.WorkingDir != want {
+		t.Errorf("added working dir = %q, want %q", env.WorkingDir, want)
+	}
+	if want := filepath.Join(e.home, ".env"); env.EnvFile != want {
+		t.Errorf("added env file = %q, want %q", env.EnvFile, want)
+	}
+
+	e.mustRun("environment", "update", "--working-dir", "~/work", "--env-file", "proj.env", "proj")
+	env = e.state().Environments["proj"]
+	if want := filepath.Join(e.home, "work"); env.WorkingDir != want {
+		t.Errorf("updated working dir = %q, want %q", env.WorkingDir, want)
+	}
+	if want := filepath.Join(project, "proj.env"); env.EnvFile != want {
+		t.Errorf("updated env file = %q, want %q", env.EnvFile, want)
+	}
+
+	e.mustRun("environment", "update", "--working-dir", "", "proj")
+	if got := e.state().Environments["proj"].WorkingDir; got != "" {
+		t.Errorf("cleared working dir = %q, want none", got)
+	}
+}
+
+func TestInitConfigDirExpanded(t *testing.T) {
+	e := newTestEnv(t)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ configDir, want string }{
+		{"~/.emacs.d", filepath.Join(e.home, ".emacs.d")},
+		{"$HOME/emacs", filepath.Join(e.home, "emacs")},
+		{"emacs.d", filepath.Join(cwd, "emacs.d")},
+	} {
+		e.mustRun("init", "--force", "--emacs-path", "/opt/emacs29/bin/emacs", "--config-dir", tt.configDir, "--no-verify")
+		if got := e.state().Configs["default"].InitDir; got != tt.want {
+			t.Errorf("init dir of %q = %q, want %q", tt.configDir, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveEnvironmentGuards(t *testing.T) {
+	e, _ := newRunnerEnv(t)
+	e.mustRun("environment", "add", "--extends", "dev", "--arg", "-Q", "child")
+
+	if _, err := e.run("environment", "remove", "--force", "dev"); !stderrors.As(err, new(errors.EnvironmentInUseError)) {
+		t.Errorf("--force of extended environment: err = %v, want EnvironmentInUseError", err)
+	}
+	if _, err := e.run("environment", "remove", "--dangling", "dev"); !stderrors.As(err, new(errors.ActiveContextError)) {
+		t.Errorf("--dangling of active context: err = %v, want ActiveContextError", err)
+	}
+	if _, ok := e.state().Environments["dev"]; !ok {
+		t.Fatal("environment dev removed by a refused removal")
+	}
+
+	out := e.mustRun("environment", "remove", "--dangling", "--force", "dev")
+	if out != "cleared context\n" {
+		t.Errorf("forced removal printed %q, want cleared context", out)
+	}
+	s := e.state()
+	if s.Context != "" {
+		t.Errorf("context = %q after forced removal, want none", s.Context)
+	}
+	if got := s.Environments["child"].Extends; got != "dev" {
+		t.Errorf("child extends %q, want it left dangling on dev", got)
+	}
+}
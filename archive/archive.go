@@ -0,0 +1,221 @@
+// Package archive provides bundling of a state file and configuration
+// directories into a single gzipped tar archive.
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+// StateName is the name of the state file in an archive.
+const StateName = "state.json"
+
+// ConfigsDir is the directory of the bundled configuration directories in an archive.
+const ConfigsDir = "configs"
+
+// ConfigPath returns the slash-separated path of a bundled configuration
+// directory relative to the root of an archive.
+func ConfigPath(name string) string {
+	return path.Join(ConfigsDir, name)
+}
+
+// Write writes a gzipped tar archive containing the state file data and the
+// files of the configuration directories, keyed by configuration name.
+// Symbolic links are archived as links rather than followed.
+func Write(archivePath string, stateData []byte, configDirs map[string]string) (err error) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	if err := tw.WriteHeader(&tar.Header{Name: StateName, Mode: 0644, Size: int64(len(stateData))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(stateData); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(configDirs))
+	for name := range configDirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := addDir(tw, configDirs[name], ConfigPath(name)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// addDir adds the files of a directory to a tar archive under a prefix.
+func addDir(tw *tar.Writer, dir, prefix string) error {
+	return filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+}
+
+// Extract extracts a gzipped tar archive into a directory, refusing any entry
+// or symbolic link that would reach outside of it, including through symbolic
+// links extracted before it.
+func Extract(archivePath, dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		if !filepath.IsLocal(name) {
+			return errors.UnsafeArchiveEntryError{Name: header.Name}
+		}
+		target := filepath.Join(root, filepath.FromSlash(name))
+		if target == root {
+			continue
+		}
+		parent, err := resolveParent(root, target)
+		if err != nil {
+			return err
+		}
+		if !isInside(root, parent) {
+			return errors.UnsafeArchiveEntryError{Name: header.Name}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(header.Linkname) || !isInside(root, filepath.Join(parent, filepath.FromSlash(header.Linkname))) {
+				return errors.UnsafeArchiveEntryError{Name: header.Name}
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := extractFile(tr, target, header.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resolveParent returns the parent directory of a target path with the
+// symbolic links of its existing ancestors resolved.
+func resolveParent(root, target string) (string, error) {
+	dir, rest := filepath.Dir(target), ""
+	for dir != root {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		dir, rest = filepath.Dir(dir), filepath.Join(filepath.Base(dir), rest)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, rest), nil
+}
+
+// isInside reports whether a path is the root directory or within it.
+func isInside(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// extractFile writes the content of the current entry of a tar archive to a file.
+func extractFile(tr *tar.Reader, target string, perm fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, tr); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
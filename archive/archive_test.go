@@ -0,0 +1,123 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	stderrors "errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+// writeTar writes a gzipped tar archive of headers, regular files having their
+// name as content, and returns its path.
+func writeTar(t *testing.T, headers []tar.Header) string {
+	t.Helper()
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+			header.Mode = 0644
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(header.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+func TestWriteExtract(t *testing.T) {
+	configDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(configDir, "lisp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "lisp", "init-ui.el"), []byte("(provide 'init-ui)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("lisp/init-ui.el", filepath.Join(configDir, "ui.el")); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "export.tar.gz")
+	if err := Write(archivePath, []byte("{}"), map[string]string{"vanilla": configDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := Extract(archivePath, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, StateName)); err != nil || string(data) != "{}" {
+		t.Errorf("state = %q, %v, want {}", data, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "configs", "vanilla", "ui.el"))
+	if err != nil || string(data) != "(provide 'init-ui)" {
+		t.Errorf("ui.el = %q, %v, want the content of lisp/init-ui.el", data, err)
+	}
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []tar.Header
+	}{
+		{"parent entry", []tar.Header{
+			{Name: "../evil", Typeflag: tar.TypeReg},
+		}},
+		{"absolute link", []tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		}},
+		{"parent link", []tar.Header{
+			{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		}},
+		{"chain of links", []tar.Header{
+			{Name: "a/b/", Typeflag: tar.TypeDir},
+			{Name: "a/b/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/escape", Typeflag: tar.TypeSymlink, Linkname: "b/up/../.."},
+			{Name: "a/escape/evil", Typeflag: tar.TypeReg},
+		}},
+		{"link to a link", []tar.Header{
+			{Name: "a/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/up/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "extract")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := Extract(writeTar(t, tt.headers), dir)
+			if !stderrors.As(err, new(errors.UnsafeArchiveEntryError)) {
+				t.Errorf("err = %v, want UnsafeArchiveEntryError", err)
+			}
+			entries, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("extraction wrote %d entries next to its directory, want none", len(entries)-1)
+			}
+		})
+	}
+}
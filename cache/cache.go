@@ -2,27 +2,291 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mojochao/emacsctl/errors"
 )
 
-// IsCached checks if a repository is cached in the cache directory.
+// waitDelay is how long to wait for the helper processes of a killed git
+// command, which inherit its output, before giving up on them.
+const waitDelay = time.Second
+
+// RepoInfo represents information about a repository in the cache directory.
+type RepoInfo struct {
+	Name   string
+	URL    string
+	Branch string
+	Commit string
+	Dirty  bool
+	Size   int64
+}
+
+// IsCached checks if a repository is cached in the cache directory. A directory
+// without a .git directory, such as one left behind by an interrupted clone, is
+// not a cached repository.
 func IsCached(cacheDir, repoName string) bool {
-	repoDir := filepath.Join(cacheDir, repoName)
-	_, err := os.Stat(repoDir)
-	return !os.IsNotExist(err)
+	info, err := os.Stat(filepath.Join(cacheDir, repoName, ".git"))
+	return err == nil && info.IsDir()
 }
 
-// AddRepo adds a repository to the cache directory and returns its location in it.
-func AddRepo(cacheDir, repoName, repoUrl string) (string, error) {
+// AddRepo adds a repository to the cache directory and returns its location in
+// it. If depth is positive, the repository is shallow cloned with that many commits.
+// The repository is cloned into a temporary directory and only moved into place
+// once complete, so a failed clone never leaves a partial repository behind. Any
+// directory left in its place that is not a cached repository is replaced.
+func AddRepo(ctx context.Context, cacheDir, repoName, repoUrl string, depth int) (string, error) {
 	repoDir := filepath.Join(cacheDir, repoName)
-	if err := cloneRepo(repoDir, repoUrl); err != nil {
+	tempDir, err := os.MkdirTemp(cacheDir, "."+repoName+".clone-")
+	if err != nil {
+		return repoDir, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := cloneRepo(ctx, tempDir, repoUrl, depth); err != nil {
+		return repoDir, err
+	}
+	if !IsCached(cacheDir, repoName) {
+		if err := os.RemoveAll(repoDir); err != nil {
+			return repoDir, err
+		}
+	}
+	if err := os.Rename(tempDir, repoDir); err != nil {
 		return repoDir, err
 	}
 	return repoDir, nil
 }
 
+// ReplaceRepo clones a repository again in place of one in the cache directory
+// and returns its location in it. The existing repository is only replaced once
+// the clone is complete, so a failed clone leaves it untouched.
+func ReplaceRepo(ctx context.Context, cacheDir, repoName, repoUrl string, depth int) (string, error) {
+	repoDir := filepath.Join(cacheDir, repoName)
+	tempDir, err := os.MkdirTemp(cacheDir, "."+repoName+".clone-")
+	if err != nil {
+		return repoDir, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := cloneRepo(ctx, tempDir, repoUrl, depth); err != nil {
+		return repoDir, err
+	}
+	oldDir := tempDir + ".old"
+	if err := os.Rename(repoDir, oldDir); err != nil {
+		return repoDir, err
+	}
+	if err := os.Rename(tempDir, repoDir); err != nil {
+		_ = os.Rename(oldDir, repoDir)
+		return repoDir, err
+	}
+	return repoDir, os.RemoveAll(oldDir)
+}
+
+// UpdateRepo pulls the latest changes into a repository in the cache
+// directory. If depth is positive, the repository is kept a shallow clone with
+// that many commits, otherwise a shallow clone is converted to a full clone.
+func UpdateRepo(ctx context.Context, cacheDir, repoName string, depth int) error {
+	repoDir := filepath.Join(cacheDir, repoName)
+	if depth <= 0 {
+		shallow, err := gitOutput(ctx, repoDir, "rev-parse", "--is-shallow-repository")
+		if err != nil {
+			return err
+		}
+		if shallow == "true" {
+			if _, err := gitOutput(ctx, repoDir, "fetch", "--unshallow"); err != nil {
+				return err
+			}
+		}
+	}
+	return pullRepo(ctx, repoDir, depth)
+}
+
+// Compose builds a directory of symlinks to the files of source directories.
+// Sources are linked in order, so a file in a later source takes precedence
+// over a file at the same relative path in an earlier one. Any previously
+// composed directory is replaced, and git metadata is never linked.
+func Compose(composedDir string, sourceDirs []string) error {
+	if err := os.RemoveAll(composedDir); err != nil {
+		return err
+	}
+	for _, sourceDir := range sourceDirs {
+		sourceDir, err := filepath.Abs(sourceDir)
+		if err != nil {
+			return err
+		}
+		err = filepath.WalkDir(sourceDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() && entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			rel, err := filepath.Rel(sourceDir, path)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(composedDir, rel)
+
+			// Replace whatever an earlier source linked here unless both are directories.
+			if info, err := os.Lstat(target); err == nil && !(entry.IsDir() && info.IsDir()) {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+			if entry.IsDir() {
+				return os.MkdirAll(target, 0755)
+			}
+			return os.Symlink(path, target)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunHook runs a hook command line in a repository directory.
+func RunHook(repoDir string, hook []string) error {
+	if len(hook) == 0 {
+		return nil
+	}
+	cmd := exec.Command(hook[0], hook[1:]...)
+	cmd.Dir = repoDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ListRepos returns the names of all repositories in the cache directory,
+// ignoring hidden directories such as those of clones in progress.
+func ListRepos(cacheDir string) ([]string, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// Orphans returns the sorted names of all repositories in the cache directory
+// that are not among the known repository names.
+func Orphans(cacheDir string, known []string) ([]string, error) {
+	names, err := ListRepos(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, name := range names {
+		if !slices.Contains(known, name) {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// GetRepoInfo returns information about a repository in the cache directory.
+func GetRepoInfo(ctx context.Context, cacheDir, repoName string) (RepoInfo, error) {
+	repoDir := filepath.Join(cacheDir, repoName)
+	info := RepoInfo{Name: repoName}
+
+	var err error
+	if info.URL, err = gitOutput(ctx, repoDir, "remote", "get-url", "origin"); err != nil {
+		return info, err
+	}
+	if info.Branch, err = gitOutput(ctx, repoDir, "rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+		return info, err
+	}
+	if info.Commit, err = gitOutput(ctx, repoDir, "rev-parse", "HEAD"); err != nil {
+		return info, err
+	}
+	status, err := gitOutput(ctx, repoDir, "status", "--porcelain")
+	if err != nil {
+		return info, err
+	}
+	info.Dirty = status != ""
+	if info.Size, err = RepoSize(cacheDir, repoName); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// RepoSize returns the total size in bytes of the files of a repository in the cache directory.
+func RepoSize(cacheDir, repoName string) (int64, error) {
+	var size int64
+	repoDir := filepath.Join(cacheDir, repoName)
+	err := filepath.WalkDir(repoDir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// FetchRepo fetches the latest changes from the remote of a repository in the cache directory.
+func FetchRepo(ctx context.Context, cacheDir, repoName string) error {
+	repoDir := filepath.Join(cacheDir, repoName)
+	_, err := gitOutput(ctx, repoDir, "fetch", "--quiet")
+	return err
+}
+
+// AheadBehind returns the number of commits a repository in the cache
+// directory is ahead of and behind its upstream branch, as last fetched.
+func AheadBehind(ctx context.Context, cacheDir, repoName string) (int, int, error) {
+	repoDir := filepath.Join(cacheDir, repoName)
+	output, err := gitOutput(ctx, repoDir, "rev-list", "--left-right", "--count", "HEAD...@{upstream}")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var ahead, behind int
+	if _, err := fmt.Sscanf(output, "%d %d", &ahead, &behind); err != nil {
+		return 0, 0, err
+	}
+	return ahead, behind, nil
+}
+
+// CloneCommandLine returns the git command line AddRepo runs to clone a
+// repository, as if cloning it directly in place.
+func CloneCommandLine(cacheDir, repoName, repoUrl string, depth int) []string {
+	return append([]string{"git"}, cloneArgs(filepath.Join(cacheDir, repoName), repoUrl, depth)...)
+}
+
+// UpdateCommandLine returns the git command line UpdateRepo runs to pull the
+// latest changes into a repository in the cache directory.
+func UpdateCommandLine(cacheDir, repoName string, depth int) []string {
+	return append([]string{"git", "-C", filepath.Join(cacheDir, repoName)}, pullArgs(depth)...)
+}
+
 // RemoveRepo removes a repository from the cache directory.
 func RemoveRepo(cacheDir, repoName string) error {
 	repoDir := filepath.Join(cacheDir, repoName)
@@ -30,8 +294,60 @@ func RemoveRepo(cacheDir, repoName string) error {
 }
 
 // cloneRepo clones a git repository into the cache directory.
-func cloneRepo(repoDir, repoUrl string) error {
-	cmd := "git"
-	args := []string{"clone", repoUrl, repoDir}
-	return exec.Command(cmd, args...).Run()
+func cloneRepo(ctx context.Context, repoDir, repoUrl string, depth int) error {
+	_, err := runGit(ctx, cloneArgs(repoDir, repoUrl, depth)...)
+	return err
+}
+
+// cloneArgs returns the git arguments cloning a repository into a directory.
+func cloneArgs(repoDir, repoUrl string, depth int) []string {
+	args := []string{"clone", "--quiet"}
+	if depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(depth))
+	}
+	return append(args, repoUrl, repoDir)
+}
+
+// pullRepo pulls the latest changes into a git repository in the cache directory.
+func pullRepo(ctx context.Context, repoDir string, depth int) error {
+	_, err := gitOutput(ctx, repoDir, pullArgs(depth)...)
+	return err
+}
+
+// pullArgs returns the git arguments pulling the latest changes into a repository.
+func pullArgs(depth int) []string {
+	args := []string{"pull", "--ff-only"}
+	if depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(depth))
+	}
+	return args
+}
+
+// gitOutput runs a git command in a repository directory and returns its trimmed output.
+func gitOutput(ctx context.Context, repoDir string, args ...string) (string, error) {
+	return runGit(ctx, append([]string{"-C", repoDir}, args...)...)
+}
+
+// runGit runs a git command and returns its trimmed output. If the command
+// fails, the returned error includes what git reported on stderr. The command
+// is killed when the context is done, and never prompts for credentials.
+func runGit(ctx context.Context, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.WaitDelay = waitDelay
+	cmd.Stderr = &stderr
+	slog.Debug("exec", "argv", cmd.Args)
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", errors.GitTimeoutError{Cmd: "git " + strings.Join(args, " ")}
+	}
+	if err != nil {
+		return "", errors.GitError{
+			Cmd:    "git " + strings.Join(args, " "),
+			Output: strings.TrimSpace(stderr.String()),
+			Err:    err,
+		}
+	}
+	return strings.TrimSpace(string(output)), nil
 }
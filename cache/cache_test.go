@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"context"
+	stderrors "errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+func TestAddRepoBogusURL(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	cacheDir := t.TempDir()
+	bogusURL := "file://" + filepath.Join(t.TempDir(), "no-such-repo")
+
+	_, err := AddRepo(context.Background(), cacheDir, "bogus", bogusURL, 0)
+	var gitErr errors.GitError
+	if !stderrors.As(err, &gitErr) {
+		t.Fatalf("err = %v, want GitError", err)
+	}
+	if !strings.Contains(gitErr.Output, "no-such-repo") {
+		t.Errorf("git error output = %q, want what git reported on stderr", gitErr.Output)
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("failed clone left %s behind in the cache directory", entries[0].Name())
+	}
+	if IsCached(cacheDir, "bogus") {
+		t.Error("failed clone is cached")
+	}
+}
+
+func TestIsCached(t *testing.T) {
+	cacheDir := t.TempDir()
+	for _, dir := range []string{"empty", filepath.Join("repo", ".git"), "file-git"} {
+		if err := os.MkdirAll(filepath.Join(cacheDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, "file-git", ".git"), []byte("gitdir: elsewhere"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		repoName string
+		want     bool
+	}{
+		{"empty", false},
+		{"repo", true},
+		{"file-git", false},
+		{"missing", false},
+	}
+	for _, tt := range tests {
+		if got := IsCached(cacheDir, tt.repoName); got != tt.want {
+			t.Errorf("IsCached(%s) = %t, want %t", tt.repoName, got, tt.want)
+		}
+	}
+}
@@ -2,13 +2,32 @@
 package config
 
 import (
+	"log/slog"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mojochao/emacsctl/errors"
 )
 
 // AppName is the name of the application.
 const AppName = "emacsctl"
 
+// Version is the version of the application, set at build time with:
+//
+//	go build -ldflags "-X github.com/mojochao/emacsctl/config.Version=$(cat VERSION)" .
+var Version string
+
+// AppVersion returns the version of the application, or "dev" if it was not set at build time.
+func AppVersion() string {
+	if Version == "" {
+		return "dev"
+	}
+	return Version
+}
+
 // AppDescription is the description of the application.
 const AppDescription = `This app enables users to manage multiple emacs environments.
 It enables you to define different emacs command lines and configuration
@@ -18,53 +37,255 @@ files with the desired emacs command and configuration.
 This app stores its state in a JSON file in the application directory. The
 application directory is located in the user's ~/.config/emacsctl' by default,
 but can be overridden with the --app-dir flag. The state file is named state.json
-and is located in the application directory.`
+and is located in the application directory, unless a state file elsewhere is
+provided with the --state-file flag, which takes precedence over --app-dir. Its
+cache is then kept next to it.
 
-// AppDir is the location of the application state file in unexpanded form.
-// This variable is set by the app at runtime.
-var AppDir string
+Like git, when neither flag is provided, the current directory and its parents
+are searched for a project-local .emacsctl/state.json, which is used if found.
+Use the --global flag to ignore it, or the --local flag to create one in the
+current directory if none is found.
 
-// DryRun controls whether the application should execute commands or print them.
-// This variable is set by the app at runtime.
-var DryRun bool
+Cloned git repositories are kept in ~/.cache/emacsctl, or in emacsctl in
+$XDG_CACHE_HOME if set, unless overridden with the --cache-dir flag. A cache
+directory already next to the state file keeps being used.`
 
-// Verbose controls whether the application should print verbose output.
-// This variable is set by the app at runtime.
-var Verbose bool
+// Config is the runtime configuration of the application, set from its
+// global flags. It is passed to commands explicitly rather than kept in
+// package variables, so that multiple configurations can be used at once.
+type Config struct {
+	// AppDir is the location of the application directory, in unexpanded form until resolved.
+	AppDir string
+
+	// StateFile is the location of a state file overriding the one in the
+	// application directory, in unexpanded form until resolved.
+	StateFile string
+
+	// CacheDir is the location of the application cache directory overriding
+	// the default one, in unexpanded form until resolved.
+	CacheDir string
+
+	// Local controls whether a project-local state file is used, even if none exists yet.
+	Local bool
+
+	// Global controls whether the state file in the application directory is
+	// used, even if a project-local state file exists.
+	Global bool
+
+	// DryRun controls whether the application should execute commands or print them.
+	DryRun bool
+
+	// Verbose controls whether the application should print verbose output.
+	Verbose bool
+
+	// Quiet controls whether the application should suppress non-essential output.
+	Quiet bool
+
+	// NoColor controls whether the application should print colorized output.
+	NoColor bool
+
+	// GitTimeout is the maximum duration of any single git operation.
+	GitTimeout time.Duration
+
+	// LogLevel is the minimum level of the diagnostics logged to stderr.
+	LogLevel slog.Level
+}
 
-// Context controls the configuration context to use.
+// New returns a new configuration using the default application directory.
+func New() *Config {
+	return &Config{
+		AppDir:     DefaultAppDir,
+		GitTimeout: DefaultGitTimeout,
+		LogLevel:   slog.LevelError,
+	}
+}
+
+// Current is the configuration used by the package-level path functions.
 // This variable is set by the app at runtime.
-var Context string
+//
+// Deprecated: Use the methods of a Config instead.
+var Current = New()
+
+// DefaultGitTimeout is the default maximum duration of any single git operation.
+const DefaultGitTimeout = 2 * time.Minute
 
 // DefaultAppDir is the default application directory when not provided.
+// It is empty if the home directory cannot be determined.
 var DefaultAppDir, _ = HomeDirPath(".config", AppName)
 
+// DefaultCacheDir is the default application cache directory, located in
+// $XDG_CACHE_HOME, or else in ~/.cache, so that cloned repositories are kept
+// out of the application directory. It is empty if neither can be determined.
+var DefaultCacheDir = defaultCacheDir()
+
+// defaultCacheDir returns the default application cache directory.
+func defaultCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, AppName)
+	}
+	dir, _ := HomeDirPath(".cache", AppName)
+	return dir
+}
+
 // DefaultEmacsCommandLine is the default emacs command line when not provided.
 const DefaultEmacsCommandLine = "emacs"
 
 // DefaultEmacsConfigDir defines the default emacs configuration directory when not provided.
+// It is empty if the home directory cannot be determined.
 var DefaultEmacsConfigDir, _ = HomeDirPath(".emacs.d")
 
+// ResolveAppDir expands any leading ~ or ~user and environment variable
+// references in AppDir, StateFile and CacheDir, so that no path is derived
+// from the raw flag values. StateFile is also made absolute, as paths are
+// derived from it.
+func (c *Config) ResolveAppDir() error {
+	appDir, err := ExpandPath(c.AppDir)
+	if err != nil {
+		return err
+	}
+	c.AppDir = appDir
+	if c.CacheDir, err = ExpandPath(c.CacheDir); err != nil {
+		return err
+	}
+	if c.StateFile == "" {
+		return nil
+	}
+	stateFile, err := ExpandPath(c.StateFile)
+	if err != nil {
+		return err
+	}
+	c.StateFile, err = filepath.Abs(stateFile)
+	return err
+}
+
+// ExpandPath expands environment variable references and a leading ~ or
+// ~user home directory reference in a path.
+func ExpandPath(path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+
+	name, rest, _ := strings.Cut(path[1:], string(filepath.Separator))
+	if name == "" {
+		return HomeDirPath(rest)
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, rest), nil
+}
+
 // AppPath returns the absolute path of the application directory with the provided path parts.
-func AppPath(parts ...string) string {
-	return filepath.Join(append([]string{AppDir}, parts...)...)
+func (c *Config) AppPath(parts ...string) string {
+	return filepath.Join(append([]string{c.AppDir}, parts...)...)
 }
 
 // StatePath returns the absolute path of the application state file.
-func StatePath() string {
-	return AppPath("state.json")
+func (c *Config) StatePath() string {
+	if c.StateFile != "" {
+		return c.StateFile
+	}
+	return c.AppPath("state.json")
 }
 
 // CachePath returns the absolute path of the application cache directory with the provided path parts.
+func (c *Config) CachePath(parts ...string) string {
+	return filepath.Join(append([]string{c.cacheDir()}, parts...)...)
+}
+
+// cacheDir returns the application cache directory. Unless provided with
+// CacheDir, it is DefaultCacheDir, except that the cache directory next to the
+// state file is used if it already exists, as it did before the default moved,
+// or if the state file or application directory is not the default one, so
+// that the repositories of different state files are not mixed.
+func (c *Config) cacheDir() string {
+	if c.CacheDir != "" {
+		return c.CacheDir
+	}
+	stateCacheDir := c.statePath("cache")
+	if info, err := os.Stat(stateCacheDir); err == nil && info.IsDir() {
+		return stateCacheDir
+	}
+	if c.StateFile != "" || c.AppDir != DefaultAppDir || DefaultCacheDir == "" {
+		return stateCacheDir
+	}
+	return DefaultCacheDir
+}
+
+// ComposedPath returns the absolute path of the application directory of
+// configurations composed from multiple sources with the provided path parts.
+func (c *Config) ComposedPath(parts ...string) string {
+	return c.statePath(append([]string{"composed"}, parts...)...)
+}
+
+// ConfigsPath returns the absolute path of the application directory of
+// configurations imported from archives with the provided path parts.
+func (c *Config) ConfigsPath(parts ...string) string {
+	return c.statePath(append([]string{"configs"}, parts...)...)
+}
+
+// statePath returns the absolute path of the directory of the application
+// state file with the provided path parts.
+func (c *Config) statePath(parts ...string) string {
+	return filepath.Join(append([]string{filepath.Dir(c.StatePath())}, parts...)...)
+}
+
+// AppPath returns the absolute path of the application directory of the
+// Current configuration with the provided path parts.
+//
+// Deprecated: Use Config.AppPath instead.
+func AppPath(parts ...string) string {
+	return Current.AppPath(parts...)
+}
+
+// StatePath returns the absolute path of the application state file of the
+// Current configuration.
+//
+// Deprecated: Use Config.StatePath instead.
+func StatePath() string {
+	return Current.StatePath()
+}
+
+// CachePath returns the absolute path of the application cache directory of
+// the Current configuration with the provided path parts.
+//
+// Deprecated: Use Config.CachePath instead.
 func CachePath(parts ...string) string {
-	return AppPath(append([]string{"cache"}, parts...)...)
+	return Current.CachePath(parts...)
+}
+
+// LocalDirName is the name of the directory of project-local state files.
+const LocalDirName = "." + AppName
+
+// LocalStatePath returns the path of the project-local state file of a directory.
+func LocalStatePath(dir string) string {
+	return filepath.Join(dir, LocalDirName, "state.json")
+}
+
+// FindLocalStatePath searches a directory and its parents for a project-local
+// state file like git does for repositories, and returns the path of the
+// nearest one found.
+func FindLocalStatePath(dir string) (string, bool) {
+	for {
+		path := LocalStatePath(dir)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
 }
 
 // HomeDirPath returns the absolute path of the home directory with the provided path parts.
 func HomeDirPath(parts ...string) (string, error) {
 	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
+	if err != nil || homeDir == "" {
+		return "", errors.NoHomeDirError
 	}
 
 	homeDirPath := homeDir
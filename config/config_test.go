@@ -0,0 +1,88 @@
+package config
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveAppDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("EMACSCTL_TEST_DIR", "projects")
+
+	tests := []struct {
+		appDir string
+		want   string
+	}{
+		{"~", home},
+		{"~/emacs", filepath.Join(home, "emacs")},
+		{"$HOME/foo", filepath.Join(home, "foo")},
+		{"${HOME}/$EMACSCTL_TEST_DIR/emacs", filepath.Join(home, "projects", "emacs")},
+		{"/opt/emacsctl", "/opt/emacsctl"},
+		{"/opt/~/emacsctl", "/opt/~/emacsctl"},
+	}
+	for _, tt := range tests {
+		conf := &Config{AppDir: tt.appDir}
+		if err := conf.ResolveAppDir(); err != nil {
+			t.Fatalf("ResolveAppDir(%q): %v", tt.appDir, err)
+		}
+		if conf.AppDir != tt.want {
+			t.Errorf("ResolveAppDir(%q) = %q, want %q", tt.appDir, conf.AppDir, tt.want)
+		}
+		if want := filepath.Join(tt.want, "state.json"); conf.StatePath() != want {
+			t.Errorf("state path of %q = %q, want %q", tt.appDir, conf.StatePath(), want)
+		}
+	}
+}
+
+func TestExpandPathUser(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	got, err := ExpandPath("~" + current.Username + "/emacs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(current.HomeDir, "emacs"); got != want {
+		t.Errorf("ExpandPath(~%s/emacs) = %q, want %q", current.Username, got, want)
+	}
+}
+
+func TestFindLocalStatePath(t *testing.T) {
+	root := t.TempDir()
+	project := filepath.Join(root, "project")
+	nested := filepath.Join(project, "src", "lisp")
+	sub := filepath.Join(project, "sub")
+	for _, dir := range []string{nested, filepath.Join(project, LocalDirName), filepath.Join(sub, LocalDirName), filepath.Join(root, "other", LocalDirName)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{project, sub} {
+		if err := os.WriteFile(LocalStatePath(dir), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		dir   string
+		want  string
+		found bool
+	}{
+		{"project dir", project, LocalStatePath(project), true},
+		{"nested dir", nested, LocalStatePath(project), true},
+		{"nearest wins", sub, LocalStatePath(sub), true},
+		{"dir without state file", filepath.Join(root, "other"), "", false},
+		{"outside any project", root, "", false},
+	}
+	for _, tt := range tests {
+		got, found := FindLocalStatePath(tt.dir)
+		if got != tt.want || found != tt.found {
+			t.Errorf("%s: FindLocalStatePath = %q, %t, want %q, %t", tt.name, got, found, tt.want, tt.found)
+		}
+	}
+}
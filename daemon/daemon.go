@@ -0,0 +1,46 @@
+// Package daemon provides emacs server (daemon) and client support.
+package daemon
+
+import (
+	"io"
+	"os/exec"
+	"path/filepath"
+)
+
+// ClientBinName is the name of the emacs client binary.
+const ClientBinName = "emacsclient"
+
+// ClientPath returns the path of the emacs client binary installed alongside
+// the emacs binary at binPath.
+func ClientPath(binPath string) string {
+	dir := filepath.Dir(binPath)
+	if dir == "." {
+		return ClientBinName
+	}
+	return filepath.Join(dir, ClientBinName)
+}
+
+// IsRunning checks if an emacs server named serverName is running and
+// accepting connections from the client binary at clientPath, running the
+// client with run. A server that is not running is not an error, but a client
+// binary that cannot be run is.
+func IsRunning(run func(cmd *exec.Cmd) error, clientPath, serverName string) (bool, error) {
+	cmd := exec.Command(clientPath, "--socket-name", serverName, "--eval", "t")
+	cmd.Stderr = io.Discard
+	err := run(cmd)
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ClientCommandLine returns the command line that opens files in a new frame
+// of the emacs server named serverName.
+func ClientCommandLine(clientPath string, clientArgs []string, serverName string, files []string) []string {
+	args := make([]string, 0, len(clientArgs)+len(files)+4)
+	args = append(args, clientPath)
+	args = append(args, clientArgs...)
+	args = append(args, "--socket-name", serverName, "--create-frame")
+	args = append(args, files...)
+	return args
+}
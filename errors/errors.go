@@ -1,6 +1,9 @@
 package errors
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type UnexpectedNumArgsError struct {
 	Expected int
@@ -20,6 +23,24 @@ func (e MinimumNumArgsError) Error() string {
 	return fmt.Sprintf("minimum number of arguments not met: minimum %d, got %d", e.Minimum, e.Received)
 }
 
+type InvalidValueError struct {
+	Name  string
+	Value string
+}
+
+func (e InvalidValueError) Error() string {
+	return fmt.Sprintf("invalid value for %s: %s", e.Name, e.Value)
+}
+
+type InvalidPatternError struct {
+	Pattern string
+	Reason  string
+}
+
+func (e InvalidPatternError) Error() string {
+	return fmt.Sprintf("invalid pattern %s: %s", e.Pattern, e.Reason)
+}
+
 type CommandExistsError struct {
 	Name string
 }
@@ -36,6 +57,32 @@ func (e CommandNotFoundError) Error() string {
 	return "command not found: " + e.Name
 }
 
+type InvalidCommandLineError struct {
+	CommandLine string
+	Reason      string
+}
+
+func (e InvalidCommandLineError) Error() string {
+	return fmt.Sprintf("invalid command line %q: %s", e.CommandLine, e.Reason)
+}
+
+type InvalidCommandError struct {
+	Name string
+}
+
+func (e InvalidCommandError) Error() string {
+	return "invalid command, missing binary path: " + e.Name
+}
+
+type CommandInUseError struct {
+	Name         string
+	Environments []string
+}
+
+func (e CommandInUseError) Error() string {
+	return fmt.Sprintf("command %s is used by environments: %s (use --force to remove it anyway)", e.Name, strings.Join(e.Environments, ", "))
+}
+
 type ConfigExistsError struct {
 	Name string
 }
@@ -52,6 +99,72 @@ func (e ConfigNotFoundError) Error() string {
 	return "config not found: " + e.Name
 }
 
+type InvalidConfigError struct {
+	Name string
+}
+
+func (e InvalidConfigError) Error() string {
+	return "invalid config, missing init directory: " + e.Name
+}
+
+type ConfigInUseError struct {
+	Name         string
+	Environments []string
+}
+
+func (e ConfigInUseError) Error() string {
+	return fmt.Sprintf("config %s is used by environments: %s (use --force to remove it anyway)", e.Name, strings.Join(e.Environments, ", "))
+}
+
+type ConfigNotCachedError struct {
+	Name string
+}
+
+func (e ConfigNotCachedError) Error() string {
+	return "config not cached: " + e.Name
+}
+
+type ConfigNotFetchedError struct {
+	Name string
+}
+
+func (e ConfigNotFetchedError) Error() string {
+	return fmt.Sprintf("config %s is not cloned yet (run 'config fetch %s' first)", e.Name, e.Name)
+}
+
+type ConfigNotGitBackedError struct {
+	Name string
+}
+
+func (e ConfigNotGitBackedError) Error() string {
+	return "config not git-backed: " + e.Name
+}
+
+type ConfigURLUnknownError struct {
+	Name string
+}
+
+func (e ConfigURLUnknownError) Error() string {
+	return "config repository URL unknown: " + e.Name
+}
+
+type ConfigFetchError struct {
+	Names []string
+}
+
+func (e ConfigFetchError) Error() string {
+	return "failed to fetch configs: " + strings.Join(e.Names, ", ")
+}
+
+type TemplateNotFoundError struct {
+	Name      string
+	Available []string
+}
+
+func (e TemplateNotFoundError) Error() string {
+	return fmt.Sprintf("template not found: %s (available: %s)", e.Name, strings.Join(e.Available, ", "))
+}
+
 type EnvironmentExistsError struct {
 	Name string
 }
@@ -68,4 +181,233 @@ func (e EnvironmentNotFoundError) Error() string {
 	return "environment not found: " + e.Name
 }
 
+type EnvironmentCycleError struct {
+	Chain []string
+}
+
+func (e EnvironmentCycleError) Error() string {
+	return "environment inheritance cycle: " + strings.Join(e.Chain, " -> ")
+}
+
+type ActiveContextError struct {
+	Name string
+}
+
+func (e ActiveContextError) Error() string {
+	return fmt.Sprintf("environment %s is the active context (switch context first, or use --force to remove it anyway)", e.Name)
+}
+
+type EnvironmentInUseError struct {
+	Name         string
+	Environments []string
+}
+
+func (e EnvironmentInUseError) Error() string {
+	return fmt.Sprintf("environment %s is extended by environments: %s (use --dangling to remove it anyway)", e.Name, strings.Join(e.Environments, ", "))
+}
+
+type UnsupportedVersionError struct {
+	Version   int
+	Supported int
+}
+
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported state version %d: this version of emacsctl supports up to version %d", e.Version, e.Supported)
+}
+
+type GitError struct {
+	Cmd    string
+	Output string
+	Err    error
+}
+
+func (e GitError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s: %s", e.Cmd, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Cmd, e.Err, strings.ReplaceAll(e.Output, "\n", "; "))
+}
+
+type InitDirNotFoundError struct {
+	Config string
+	Path   string
+}
+
+func (e InitDirNotFoundError) Error() string {
+	return fmt.Sprintf("init directory of configuration %s not found: %s (create it, or run 'config update %s' if it is cloned from git)", e.Config, e.Path, e.Config)
+}
+
+type EnvFileNotFoundError struct {
+	Path string
+}
+
+func (e EnvFileNotFoundError) Error() string {
+	return fmt.Sprintf("env file not found: %s", e.Path)
+}
+
+type InvalidEnvFileError struct {
+	Path string
+	Line int
+	Text string
+}
+
+func (e InvalidEnvFileError) Error() string {
+	return fmt.Sprintf("invalid env file: %s:%d: expected KEY=VALUE, got %q", e.Path, e.Line, e.Text)
+}
+
+type InvalidTemplateError struct {
+	Template string
+	Err      error
+}
+
+func (e InvalidTemplateError) Error() string {
+	return fmt.Sprintf("invalid format template %q: %s", e.Template, e.Err)
+}
+
+func (e InvalidTemplateError) Unwrap() error {
+	return e.Err
+}
+
+type InvalidTOMLError struct {
+	Line   int
+	Reason string
+}
+
+func (e InvalidTOMLError) Error() string {
+	if e.Line == 0 {
+		return "invalid TOML: " + e.Reason
+	}
+	return fmt.Sprintf("invalid TOML: line %d: %s", e.Line, e.Reason)
+}
+
+type UnsafeArchiveEntryError struct {
+	Name string
+}
+
+func (e UnsafeArchiveEntryError) Error() string {
+	return fmt.Sprintf("unsafe archive entry outside of the extraction directory: %s", e.Name)
+}
+
+type HookError struct {
+	Name string
+	Err  error
+}
+
+func (e HookError) Error() string {
+	return fmt.Sprintf("%s hook failed: %s", e.Name, e.Err)
+}
+
+func (e HookError) Unwrap() error {
+	return e.Err
+}
+
+func (e GitError) Unwrap() error {
+	return e.Err
+}
+
+type CommandTestError struct {
+	Name string
+	Err  error
+}
+
+func (e CommandTestError) Error() string {
+	return fmt.Sprintf("command %s failed: %s", e.Name, e.Err)
+}
+
+func (e CommandTestError) Unwrap() error {
+	return e.Err
+}
+
+type GitTimeoutError struct {
+	Cmd string
+}
+
+func (e GitTimeoutError) Error() string {
+	return "timed out: " + e.Cmd
+}
+
+type ForceRequiredError struct {
+	Action string
+}
+
+func (e ForceRequiredError) Error() string {
+	return fmt.Sprintf("refusing to %s without --force", e.Action)
+}
+
+type NotADirectoryError struct {
+	Path string
+}
+
+func (e NotADirectoryError) Error() string {
+	return "not a directory: " + e.Path
+}
+
+type StateExistsError struct {
+	Path string
+}
+
+func (e StateExistsError) Error() string {
+	return "state already exists, use --force to overwrite it: " + e.Path
+}
+
+type StateLockedError struct {
+	Path string
+}
+
+func (e StateLockedError) Error() string {
+	return "timed out waiting for another emacsctl to release the state lock: " + e.Path
+}
+
+type BackupNotFoundError struct {
+	Path string
+}
+
+func (e BackupNotFoundError) Error() string {
+	return "backup not found: " + e.Path
+}
+
+type ConflictingEnvironmentError struct {
+	First  string
+	Second string
+}
+
+func (e ConflictingEnvironmentError) Error() string {
+	return fmt.Sprintf("conflicting environments selected: %s and %s", e.First, e.Second)
+}
+
+type ConflictingFlagsError struct {
+	First  string
+	Second string
+}
+
+func (e ConflictingFlagsError) Error() string {
+	return fmt.Sprintf("conflicting flags provided: %s and %s", e.First, e.Second)
+}
+
+type MissingFlagError struct {
+	First  string
+	Second string
+}
+
+func (e MissingFlagError) Error() string {
+	return fmt.Sprintf("missing flag: one of %s or %s is required", e.First, e.Second)
+}
+
+type RequiresFlagError struct {
+	Flag     string
+	Required string
+}
+
+func (e RequiresFlagError) Error() string {
+	return fmt.Sprintf("flag %s requires flag %s", e.Flag, e.Required)
+}
+
+var AbortedError = fmt.Errorf("aborted")
+
 var NoContextError = fmt.Errorf("no environment context specified or active")
+
+var NoContextHistoryError = fmt.Errorf("no previous environment context in history")
+
+var NoHomeDirError = fmt.Errorf("could not determine home directory; set $HOME or use --app-dir")
+
+var NoEmacsFoundError = fmt.Errorf("no emacs binaries found on PATH or in common install locations")
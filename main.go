@@ -5,12 +5,17 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/urfave/cli/v2"
+
 	"github.com/mojochao/emacsctl/app"
 )
 
 func main() {
 	if err := app.New().Run(os.Args); err != nil {
-		fmt.Printf("error: %s\n", err)
+		if exitCoder, ok := err.(cli.ExitCoder); ok {
+			os.Exit(exitCoder.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,197 @@
+// Package render provides rendering of list output in multiple formats.
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+
+	"github.com/mojochao/emacsctl/errors"
+	"github.com/mojochao/emacsctl/toml"
+)
+
+// Table is the format rendering a pretty table for display in a terminal.
+const Table = "table"
+
+// JSON is the format rendering a JSON array of objects keyed by column.
+const JSON = "json"
+
+// TOML is the format rendering a TOML array of tables named rows, keyed by column.
+const TOML = "toml"
+
+// Markdown is the format rendering a GitHub-flavored Markdown table.
+const Markdown = "markdown"
+
+// Names is the format rendering only the name of each row, one per line.
+const Names = "names"
+
+// Formats lists all supported output formats.
+var Formats = []string{Table, JSON, TOML, Markdown, Names}
+
+// UsedBy is the header of the column listing what uses the entity of each row.
+const UsedBy = "Used By"
+
+// ListSeparator separates the values of cells holding lists.
+const ListSeparator = ", "
+
+// listHeaders are the headers of columns whose cells hold lists of values
+// joined by ListSeparator, which JSON and TOML render as arrays.
+var listHeaders = map[string]bool{UsedBy: true}
+
+// Rows renders rows of values under column headers to w in the desired format.
+func Rows(w io.Writer, format string, headers []string, rows [][]string) error {
+	switch format {
+	case Table:
+		return renderTable(w, headers, rows)
+	case JSON:
+		return renderJSON(w, headers, rows)
+	case TOML:
+		return renderTOML(w, headers, rows)
+	case Markdown:
+		return renderMarkdown(w, headers, rows)
+	case Names:
+		return renderNames(w, headers, rows)
+	default:
+		return errors.InvalidValueError{Name: "output", Value: format}
+	}
+}
+
+// Template renders items with a text/template, executed once per item and
+// followed by a newline. Referencing a key missing from an item is an error.
+func Template(w io.Writer, text string, items []map[string]any) error {
+	tmpl, err := template.New("format").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return errors.InvalidTemplateError{Template: text, Err: err}
+	}
+	for _, item := range items {
+		if err := tmpl.Execute(w, item); err != nil {
+			return errors.InvalidTemplateError{Template: text, Err: err}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderTable renders rows as a pretty table with colored headers and names.
+func renderTable(w io.Writer, headers []string, rows [][]string) error {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+	columns := make([]interface{}, len(headers))
+	for i, header := range headers {
+		columns[i] = header
+	}
+	tbl := table.New(columns...)
+	tbl.WithWriter(w).WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt).WithWidthFunc(visibleWidth)
+	tbl.SetRows(rows)
+	tbl.Print()
+	return nil
+}
+
+// ansiEscape matches the ANSI escape sequences used to color text.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// visibleWidth returns the width of a string as displayed in a terminal,
+// ignoring any color escape sequences, so that colored cells stay aligned.
+func visibleWidth(s string) int {
+	return utf8.RuneCountInString(ansiEscape.ReplaceAllString(s, ""))
+}
+
+// rowObjects returns rows as objects keyed by lowercase header. Cells holding
+// lists are arrays keyed by their header in snake case.
+func rowObjects(headers []string, rows [][]string) []map[string]any {
+	objects := make([]map[string]any, 0, len(rows))
+	for _, row := range rows {
+		object := make(map[string]any, len(headers))
+		for i, header := range headers {
+			if !listHeaders[header] {
+				object[strings.ToLower(header)] = row[i]
+				continue
+			}
+			values := []string{}
+			if row[i] != "" {
+				values = strings.Split(row[i], ListSeparator)
+			}
+			object[strings.ToLower(strings.ReplaceAll(header, " ", "_"))] = values
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+// renderJSON renders rows as a JSON array of objects keyed by lowercase header.
+func renderJSON(w io.Writer, headers []string, rows [][]string) error {
+	data, err := json.MarshalIndent(rowObjects(headers, rows), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// renderTOML renders rows as a TOML array of tables named rows, keyed by
+// lowercase header, as a TOML document cannot be an array itself.
+func renderTOML(w io.Writer, headers []string, rows [][]string) error {
+	data, err := toml.Marshal(map[string]any{"rows": rowObjects(headers, rows)})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// renderMarkdown renders rows as a GitHub-flavored Markdown table.
+func renderMarkdown(w io.Writer, headers []string, rows [][]string) error {
+	separators := make([]string, len(headers))
+	for i := range separators {
+		separators[i] = "---"
+	}
+
+	lines := make([]string, 0, len(rows)+2)
+	lines = append(lines, markdownRow(headers), markdownRow(separators))
+	for _, row := range rows {
+		lines = append(lines, markdownRow(row))
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// markdownRow returns a Markdown table row of cells, escaping characters that
+// would otherwise break the table.
+func markdownRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		cell = strings.ReplaceAll(cell, `\`, `\\`)
+		cell = strings.ReplaceAll(cell, "|", `\|`)
+		cell = strings.ReplaceAll(cell, "\n", "<br>")
+		escaped[i] = cell
+	}
+	return "| " + strings.Join(escaped, " | ") + " |"
+}
+
+// renderNames renders the name column of rows one per line, without headers
+// or colors, so nothing at all is written when there are no rows.
+func renderNames(w io.Writer, headers []string, rows [][]string) error {
+	column := 0
+	for i, header := range headers {
+		if strings.EqualFold(header, "name") {
+			column = i
+			break
+		}
+	}
+
+	for _, row := range rows {
+		if _, err := fmt.Fprintln(w, row[column]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
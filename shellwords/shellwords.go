@@ -0,0 +1,90 @@
+// Package shellwords provides splitting of command lines into arguments the way a POSIX shell would.
+package shellwords
+
+import (
+	"strings"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+// Split splits a command line into arguments, honoring single quotes, double
+// quotes, and backslash escapes like a POSIX shell, without expanding anything.
+func Split(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.InvalidCommandLineError{CommandLine: line, Reason: "trailing backslash"}
+			}
+			i++
+			if runes[i] != '\n' {
+				arg.WriteRune(runes[i])
+			}
+			inArg = true
+		case r == '\'':
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\'' {
+					closed = true
+					break
+				}
+				arg.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, errors.InvalidCommandLineError{CommandLine: line, Reason: "unterminated single quote"}
+			}
+			inArg = true
+		case r == '"':
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == '"' {
+					closed = true
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				arg.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, errors.InvalidCommandLineError{CommandLine: line, Reason: "unterminated double quote"}
+			}
+			inArg = true
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Quote quotes an argument so that a POSIX shell, or Split, reads it back as
+// a single argument, leaving it as is if no quoting is needed.
+func Quote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, needsQuoting) < 0 {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// needsQuoting reports whether a character has a special meaning to a POSIX shell.
+func needsQuoting(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+}
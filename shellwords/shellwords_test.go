@@ -0,0 +1,111 @@
+package shellwords
+
+import (
+	stderrors "errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"emacs -nw", []string{"emacs", "-nw"}},
+		{"  emacs \t -nw\n--debug-init ", []string{"emacs", "-nw", "--debug-init"}},
+		{`'/opt/my emacs/bin/emacs' -nw`, []string{"/opt/my emacs/bin/emacs", "-nw"}},
+		{`"/opt/my emacs/bin/emacs" -nw`, []string{"/opt/my emacs/bin/emacs", "-nw"}},
+		{`/opt/my\ emacs/bin/emacs`, []string{"/opt/my emacs/bin/emacs"}},
+		{`--eval '(message "hi")'`, []string{"--eval", `(message "hi")`}},
+		{`--eval "(message \"hi\")"`, []string{"--eval", `(message "hi")`}},
+		{`'it'\''s'`, []string{"it's"}},
+		{`"a\b" "\$HOME" '\n'`, []string{`a\b`, "$HOME", `\n`}},
+		{`''`, []string{""}},
+		{`a""b`, []string{"ab"}},
+		{"a\\\nb", []string{"ab"}},
+		{"emacs $HOME ~", []string{"emacs", "$HOME", "~"}},
+	}
+	for _, tt := range tests {
+		got, err := Split(tt.line)
+		if err != nil {
+			t.Errorf("Split(%q): %v", tt.line, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Split(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	tests := []struct {
+		line   string
+		reason string
+	}{
+		{`emacs 'unterminated`, "unterminated single quote"},
+		{`emacs "unterminated`, "unterminated double quote"},
+		{`emacs "escaped quote\"`, "unterminated double quote"},
+		{`emacs trailing\`, "trailing backslash"},
+	}
+	for _, tt := range tests {
+		_, err := Split(tt.line)
+		var lineErr errors.InvalidCommandLineError
+		if !stderrors.As(err, &lineErr) || lineErr.Reason != tt.reason || lineErr.CommandLine != tt.line {
+			t.Errorf("Split(%q): err = %v, want InvalidCommandLineError with reason %s", tt.line, err, tt.reason)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"emacs", "emacs"},
+		{"--init-directory=/home/user/.emacs.d", "--init-directory=/home/user/.emacs.d"},
+		{"", "''"},
+		{"my emacs", "'my emacs'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{`(message "hi")`, `'(message "hi")'`},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.arg); got != tt.want {
+			t.Errorf("Quote(%q) = %q, want %q", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteSplitRoundTrip(t *testing.T) {
+	args := []string{
+		"emacs", "", " ", "my emacs", "it's", `"quoted"`, `back\slash`, "$HOME", "~", "*.el",
+		"tab\there", "new\nline", "'", `\`, "(setq x 'y)", "naïve café", "a;b|c&d",
+	}
+	for _, arg := range args {
+		got, err := Split(Quote(arg))
+		if err != nil {
+			t.Errorf("Split(Quote(%q)): %v", arg, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != arg {
+			t.Errorf("Split(Quote(%q)) = %q, want the argument back", arg, got)
+		}
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = Quote(arg)
+	}
+	got, err := Split(strings.Join(quoted, " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, args) {
+		t.Errorf("Split of quoted arguments = %q, want %q", got, args)
+	}
+}
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"encoding/json"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+// CurrentVersion is the version of the state file format written by Save.
+const CurrentVersion = 2
+
+// migrations upgrade a decoded state file from the version they are indexed
+// by to the next version.
+var migrations = map[int]func(doc map[string]any){
+	1: migrateV1,
+}
+
+// Migrate decodes the content of a state file of any supported version,
+// upgrading it to the current version. State files without a version are
+// version 1.
+func Migrate(raw []byte) (*State, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	version := 1
+	if value, ok := doc["version"].(float64); ok {
+		version = int(value)
+	}
+	if version < 1 || version > CurrentVersion {
+		return nil, errors.UnsupportedVersionError{Version: version, Supported: CurrentVersion}
+	}
+
+	for ; version < CurrentVersion; version++ {
+		migrations[version](doc)
+	}
+	doc["version"] = CurrentVersion
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	state.normalize()
+	return &state, nil
+}
+
+// migrateV1 upgrades an unversioned state file, which may have null or
+// missing entity maps, to version 2.
+func migrateV1(doc map[string]any) {
+	for _, key := range []string{"commands", "configs", "environments"} {
+		if doc[key] == nil {
+			doc[key] = map[string]any{}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	stderrors "errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		file         string
+		commands     int
+		configs      int
+		environments int
+	}{
+		{"v1.json", 1, 0, 0},
+		{"v2.json", 1, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			s, err := Load(filepath.Join("testdata", tt.file), "emacs", "/home/user/.emacs.d")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Version != CurrentVersion {
+				t.Errorf("version = %d, want %d", s.Version, CurrentVersion)
+			}
+			if s.Commands == nil || s.Configs == nil || s.Environments == nil {
+				t.Fatalf("entity maps not all made: %+v", s)
+			}
+			if len(s.Commands) != tt.commands || len(s.Configs) != tt.configs || len(s.Environments) != tt.environments {
+				t.Errorf("loaded %d commands, %d configs, %d environments, want %d, %d, %d",
+					len(s.Commands), len(s.Configs), len(s.Environments), tt.commands, tt.configs, tt.environments)
+			}
+			if got := s.Commands["emacs29"].BinPath; got != "/opt/emacs29/bin/emacs" {
+				t.Errorf("bin path of emacs29 = %q, want /opt/emacs29/bin/emacs", got)
+			}
+			if s.Context != "dev" {
+				t.Errorf("context = %q, want dev", s.Context)
+			}
+		})
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	s, err := Load(filepath.Join(t.TempDir(), "state.json"), "emacs", "/home/user/.emacs.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.EnvironmentExists("default") || s.Context != "default" {
+		t.Errorf("missing state file did not load the default state: %+v", s)
+	}
+}
+
+func TestLoadUnsupportedVersion(t *testing.T) {
+	_, err := Load(filepath.Join("testdata", "v3.json"), "emacs", "/home/user/.emacs.d")
+	var versionErr errors.UnsupportedVersionError
+	if !stderrors.As(err, &versionErr) {
+		t.Fatalf("err = %v, want UnsupportedVersionError", err)
+	}
+	if versionErr.Version != 3 || versionErr.Supported != CurrentVersion {
+		t.Errorf("err = %+v, want version 3 and supported %d", versionErr, CurrentVersion)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{"unversioned", `{"commands": null}`, false},
+		{"version 1", `{"version": 1, "environments": {}}`, false},
+		{"current version", `{"version": 2, "commands": {}, "configs": {}, "environments": {}}`, false},
+		{"version 0", `{"version": 0}`, true},
+		{"future version", `{"version": 99}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Migrate([]byte(tt.raw))
+			if tt.wantErr {
+				if !stderrors.As(err, new(errors.UnsupportedVersionError)) {
+					t.Errorf("err = %v, want UnsupportedVersionError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Version != CurrentVersion {
+				t.Errorf("version = %d, want %d", s.Version, CurrentVersion)
+			}
+		})
+	}
+}
+
+func TestMigrateSaveRoundTrip(t *testing.T) {
+	s, err := Load(filepath.Join("testdata", "v1.json"), "emacs", "/home/user/.emacs.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := Save(s, path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Migrate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := saved.Commands["emacs29"]
+	if !command.Equal(s.Commands["emacs29"]) || saved.Context != s.Context {
+		t.Errorf("state saved after migration = %+v, want %+v", saved, s)
+	}
+}
@@ -1,12 +1,25 @@
 // Package state provides application state management.
+//
+// It can be used as a library independently of the emacsctl CLI, as all of
+// its functions take the paths and defaults they need explicitly. A state is
+// loaded with Load, changed with its Add, Remove, Rename and Update methods,
+// which return typed errors from the errors package, and saved with Save.
 package state
 
 import (
+	"cmp"
 	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
 
-	"github.com/mojochao/emacsctl/config"
+	"github.com/mojochao/emacsctl/daemon"
 	"github.com/mojochao/emacsctl/errors"
 	"github.com/mojochao/emacsctl/util"
 )
@@ -15,52 +28,218 @@ import (
 type EmacsCommand struct {
 	BinPath     string   `json:"bin_path"`
 	BinArgs     []string `json:"bin_args"`
+	ClientPath  string   `json:"client_path,omitempty"`
+	ClientArgs  []string `json:"client_args,omitempty"`
 	Description string   `json:"description"`
+	Version     string   `json:"version,omitempty"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+	UpdatedAt   string   `json:"updated_at,omitempty"`
 }
 
-func (c *EmacsCommand) CommandLine(initDir string) []string {
-	args := make([]string, 0, len(c.BinArgs)+2)
+func (c *EmacsCommand) CommandLine(initDir string, extraArgs ...string) []string {
+	args := make([]string, 0, len(c.BinArgs)+len(extraArgs)+3)
 	args = append(args, c.BinPath)
 	args = append(args, c.BinArgs...)
+	args = append(args, extraArgs...)
 	args = append(args, "--init-directory", initDir)
 	return args
 }
 
+// DaemonCommandLine returns the command line that starts an emacs server named serverName.
+func (c *EmacsCommand) DaemonCommandLine(initDir, serverName string, extraArgs ...string) []string {
+	return append(c.CommandLine(initDir, extraArgs...), "--daemon="+serverName)
+}
+
+// Client returns the path of the emacs client binary used to connect to
+// servers started by the command.
+func (c *EmacsCommand) Client() string {
+	if c.ClientPath != "" {
+		return c.ClientPath
+	}
+	return daemon.ClientPath(c.BinPath)
+}
+
+// ClientCommandLine returns the command line that opens files in a new frame
+// of the emacs server named serverName.
+func (c *EmacsCommand) ClientCommandLine(serverName string, files []string) []string {
+	return daemon.ClientCommandLine(c.Client(), c.ClientArgs, serverName, files)
+}
+
+// Equal checks if the command has the same definition as another command. The
+// version is not part of the definition, as it depends on the machine.
+func (c *EmacsCommand) Equal(other EmacsCommand) bool {
+	return c.BinPath == other.BinPath &&
+		slices.Equal(c.BinArgs, other.BinArgs) &&
+		c.ClientPath == other.ClientPath &&
+		slices.Equal(c.ClientArgs, other.ClientArgs) &&
+		c.Description == other.Description
+}
+
 // EmacsConfig represents an emacs configuration.
 type EmacsConfig struct {
-	InitDir     string `json:"init_dir"`
-	Description string `json:"description"`
+	InitDir      string   `json:"init_dir"`
+	Description  string   `json:"description"`
+	PostCheckout []string `json:"post_checkout,omitempty"`
+	Depth        int      `json:"depth,omitempty"`
+	Sources      []string `json:"sources,omitempty"`
+	URL          string   `json:"url,omitempty"`
+	CreatedAt    string   `json:"created_at,omitempty"`
+	UpdatedAt    string   `json:"updated_at,omitempty"`
+}
+
+// Equal checks if the configuration has the same definition as another configuration.
+func (c *EmacsConfig) Equal(other EmacsConfig) bool {
+	return c.InitDir == other.InitDir &&
+		c.Description == other.Description &&
+		slices.Equal(c.PostCheckout, other.PostCheckout) &&
+		c.Depth == other.Depth &&
+		slices.Equal(c.Sources, other.Sources) &&
+		c.URL == other.URL
 }
 
 // Environment represents an emacs environment consisting of a EmacsCommand and EmacsConfig.
 type Environment struct {
-	CommandName string `json:"command_name"`
-	ConfigName  string `json:"config_name"`
-	Description string `json:"description"`
+	CommandName string            `json:"command_name"`
+	ConfigName  string            `json:"config_name"`
+	Description string            `json:"description"`
+	ExtraArgs   []string          `json:"extra_args,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	WorkingDir  string            `json:"working_dir,omitempty"`
+	EnvFile     string            `json:"env_file,omitempty"`
+	PreHook     string            `json:"pre_hook,omitempty"`
+	PostHook    string            `json:"post_hook,omitempty"`
+	Title       string            `json:"title,omitempty"`
+	Extends     string            `json:"extends,omitempty"`
+	CreatedAt   string            `json:"created_at,omitempty"`
+	UpdatedAt   string            `json:"updated_at,omitempty"`
+}
+
+// Equal checks if the environment has the same definition as another environment.
+func (e *Environment) Equal(other Environment) bool {
+	return e.CommandName == other.CommandName &&
+		e.ConfigName == other.ConfigName &&
+		e.Description == other.Description &&
+		slices.Equal(e.ExtraArgs, other.ExtraArgs) &&
+		maps.Equal(e.Env, other.Env) &&
+		e.WorkingDir == other.WorkingDir &&
+		e.EnvFile == other.EnvFile &&
+		e.PreHook == other.PreHook &&
+		e.PostHook == other.PostHook &&
+		e.Title == other.Title &&
+		e.Extends == other.Extends
+}
+
+// inherit returns the environment with the settings it does not specify taken
+// from a parent environment. Environment variables are merged, with those of
+// the environment taking precedence.
+func (e Environment) inherit(parent Environment) Environment {
+	inherited := e
+	inherited.CommandName = cmp.Or(e.CommandName, parent.CommandName)
+	inherited.ConfigName = cmp.Or(e.ConfigName, parent.ConfigName)
+	inherited.Description = cmp.Or(e.Description, parent.Description)
+	inherited.WorkingDir = cmp.Or(e.WorkingDir, parent.WorkingDir)
+	inherited.EnvFile = cmp.Or(e.EnvFile, parent.EnvFile)
+	inherited.PreHook = cmp.Or(e.PreHook, parent.PreHook)
+	inherited.PostHook = cmp.Or(e.PostHook, parent.PostHook)
+	inherited.Title = cmp.Or(e.Title, parent.Title)
+	if len(e.ExtraArgs) == 0 {
+		inherited.ExtraArgs = parent.ExtraArgs
+	}
+	if len(parent.Env) > 0 {
+		inherited.Env = maps.Clone(parent.Env)
+		maps.Copy(inherited.Env, e.Env)
+	}
+	return inherited
+}
+
+// Environ returns the environment variables of the environment as sorted
+// KEY=VALUE strings. Those of its env file are loaded first, with its own
+// variables taking precedence over them.
+func (e *Environment) Environ() ([]string, error) {
+	vars := map[string]string{}
+	if e.EnvFile != "" {
+		fileVars, err := util.ParseEnvFile(e.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(vars, fileVars)
+	}
+	maps.Copy(vars, e.Env)
+
+	environ := make([]string, 0, len(vars))
+	for _, key := range sortedKeys(vars) {
+		environ = append(environ, key+"="+vars[key])
+	}
+	return environ, nil
+}
+
+// ResolvedEnvironment represents an emacs environment with its EmacsCommand and
+// EmacsConfig resolved from the state. Its Environment includes the settings
+// inherited from its ancestors, nearest first.
+type ResolvedEnvironment struct {
+	Name        string       `json:"name"`
+	Environment Environment  `json:"environment"`
+	Ancestors   []string     `json:"ancestors,omitempty"`
+	Command     EmacsCommand `json:"command"`
+	Config      EmacsConfig  `json:"config"`
+}
+
+// CommandLine returns the command line used to open emacs in the environment.
+// If the environment has a title, it is used as the title of the initial frame.
+func (r *ResolvedEnvironment) CommandLine() []string {
+	extraArgs := r.Environment.ExtraArgs
+	if r.Environment.Title != "" {
+		extraArgs = append(slices.Clip(extraArgs), "-T", r.Environment.Title)
+	}
+	return r.Command.CommandLine(r.Config.InitDir, extraArgs...)
+}
+
+// DaemonCommandLine returns the command line that starts an emacs server for
+// the environment. As a server has no initial frame, a title of the
+// environment is set as the title format of the frames opened by clients.
+func (r *ResolvedEnvironment) DaemonCommandLine() []string {
+	extraArgs := r.Environment.ExtraArgs
+	if r.Environment.Title != "" {
+		extraArgs = append(slices.Clip(extraArgs), "--eval", "(setq frame-title-format "+strconv.Quote(r.Environment.Title)+")")
+	}
+	return r.Command.DaemonCommandLine(r.Config.InitDir, r.Name, extraArgs...)
 }
 
 // State represents the state of the application.
 type State struct {
-	Commands     map[string]EmacsCommand `json:"commands"`
-	Configs      map[string]EmacsConfig  `json:"configs"`
-	Environments map[string]Environment  `json:"environments"`
-	Context      string                  `json:"context"`
+	Version        int                     `json:"version"`
+	Commands       map[string]EmacsCommand `json:"commands"`
+	Configs        map[string]EmacsConfig  `json:"configs"`
+	Environments   map[string]Environment  `json:"environments"`
+	Context        string                  `json:"context"`
+	ContextHistory []string                `json:"context_history,omitempty"`
+	Default        string                  `json:"default,omitempty"`
 }
 
-// New returns a new, empty application state.
-func New() *State {
+// MaxContextHistory is the maximum number of previous contexts kept in the state.
+const MaxContextHistory = 10
+
+// New returns a new application state with a default environment, using the
+// emacs binary at binPath with the configuration in initDir.
+func New(binPath, initDir string) *State {
+	now := timestamp()
 	return &State{
+		Version: CurrentVersion,
 		Commands: map[string]EmacsCommand{
 			"default": {
-				BinPath:     config.DefaultEmacsCommandLine,
+				BinPath:     binPath,
 				BinArgs:     nil,
 				Description: "Default emacs application",
+				CreatedAt:   now,
+				UpdatedAt:   now,
 			},
 		},
 		Configs: map[string]EmacsConfig{
 			"default": {
-				InitDir:     config.DefaultEmacsConfigDir,
+				InitDir:     initDir,
 				Description: "Default emacs configuration",
+				CreatedAt:   now,
+				UpdatedAt:   now,
 			},
 		},
 		Environments: map[string]Environment{
@@ -68,43 +247,168 @@ func New() *State {
 				CommandName: "default",
 				ConfigName:  "default",
 				Description: "default emacs environment",
+				CreatedAt:   now,
+				UpdatedAt:   now,
 			},
 		},
 		Context: "default",
+		Default: "default",
+	}
+}
+
+// Clone returns a copy of the state that can be changed without affecting it.
+func (s *State) Clone() *State {
+	clone := &State{
+		Version:        s.Version,
+		Commands:       make(map[string]EmacsCommand, len(s.Commands)),
+		Configs:        make(map[string]EmacsConfig, len(s.Configs)),
+		Environments:   make(map[string]Environment, len(s.Environments)),
+		Context:        s.Context,
+		ContextHistory: slices.Clone(s.ContextHistory),
+		Default:        s.Default,
+	}
+	for name, command := range s.Commands {
+		clone.Commands[name] = command
+	}
+	for name, cfg := range s.Configs {
+		clone.Configs[name] = cfg
+	}
+	for name, environment := range s.Environments {
+		clone.Environments[name] = environment
+	}
+	return clone
+}
+
+// normalize initializes any nil entity maps, so that states decoded from
+// partially hand-written state files or constructed without New can be
+// safely added to. A missing context is left empty, as the default
+// environment is then used.
+func (s *State) normalize() {
+	if s.Commands == nil {
+		s.Commands = map[string]EmacsCommand{}
+	}
+	if s.Configs == nil {
+		s.Configs = map[string]EmacsConfig{}
+	}
+	if s.Environments == nil {
+		s.Environments = map[string]Environment{}
 	}
 }
 
+// Transaction stages changes to a copy of a state, applying them to the state
+// all at once on Commit, or discarding them and undoing any side effects
+// registered with OnRollback on Rollback.
+type Transaction struct {
+	State    *State
+	target   *State
+	cleanups []func() error
+}
+
+// Begin starts a new transaction staging changes to the state.
+func (s *State) Begin() *Transaction {
+	return &Transaction{State: s.Clone(), target: s}
+}
+
+// OnRollback registers a cleanup function undoing a side effect of the transaction on rollback.
+func (t *Transaction) OnRollback(cleanup func() error) {
+	t.cleanups = append(t.cleanups, cleanup)
+}
+
+// Commit applies the staged changes to the state.
+func (t *Transaction) Commit() {
+	*t.target = *t.State
+	t.cleanups = nil
+}
+
+// Rollback discards the staged changes and runs the registered cleanup
+// functions in reverse order, returning any errors they report.
+func (t *Transaction) Rollback() error {
+	var errs []error
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		if err := t.cleanups[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.cleanups = nil
+	return stderrors.Join(errs...)
+}
+
 // CommandExists checks if a command line exists in the state.
 func (s *State) CommandExists(name string) bool {
 	_, exists := s.Commands[name]
 	return exists
 }
 
-// AddCommand adds a command to the state.
-func (s *State) AddCommand(name string, commandLine []string, description string) error {
+// AddCommand adds a command to the state, with an optional client command line.
+func (s *State) AddCommand(name string, commandLine, clientLine []string, description string) error {
+	s.normalize()
 	if _, exists := s.Commands[name]; exists {
 		return errors.CommandExistsError{Name: name}
 	}
 
-	s.Commands[name] = EmacsCommand{
+	command := EmacsCommand{
 		BinPath:     commandLine[0],
 		BinArgs:     commandLine[1:],
 		Description: description,
 	}
+	if len(clientLine) > 0 {
+		command.ClientPath = clientLine[0]
+		command.ClientArgs = clientLine[1:]
+	}
+	command.CreatedAt = timestamp()
+	command.UpdatedAt = command.CreatedAt
+	s.Commands[name] = command
+	return nil
+}
+
+// AddCommandFrom adds a new emacs command to the state, copying the command
+// line of an existing base command and appending extra arguments to it.
+func (s *State) AddCommandFrom(name, base string, extraArgs []string, description string) error {
+	s.normalize()
+	if _, exists := s.Commands[name]; exists {
+		return errors.CommandExistsError{Name: name}
+	}
+	baseCommand, exists := s.Commands[base]
+	if !exists {
+		return errors.CommandNotFoundError{Name: base}
+	}
+
+	command := baseCommand
+	command.BinArgs = append(slices.Clone(baseCommand.BinArgs), extraArgs...)
+	command.ClientArgs = slices.Clone(baseCommand.ClientArgs)
+	command.Description = description
+	command.CreatedAt = timestamp()
+	command.UpdatedAt = command.CreatedAt
+	s.Commands[name] = command
 	return nil
 }
 
-// RemoveCommand removes a command from the state.
+// RemoveCommand removes a command from the state, clearing the active context
+// if it no longer resolves without it.
 func (s *State) RemoveCommand(name string) error {
-	if _, exists := s.Configs[name]; !exists {
+	if _, exists := s.Commands[name]; !exists {
 		return errors.CommandNotFoundError{Name: name}
 	}
 
-	delete(s.Configs, name)
-	s.Context = ""
+	resolved := s.contextResolves()
+	delete(s.Commands, name)
+	if resolved && !s.contextResolves() {
+		s.switchContext("")
+	}
 	return nil
 }
 
+// CommandReferences returns the sorted names of the environments using a command.
+func (s *State) CommandReferences(name string) []string {
+	var names []string
+	for _, envName := range sortedKeys(s.Environments) {
+		if s.effectiveOrOwn(envName).CommandName == name {
+			names = append(names, envName)
+		}
+	}
+	return names
+}
+
 // ConfigExists checks if a configuration exists in the state.
 func (s *State) ConfigExists(name string) bool {
 	_, exists := s.Configs[name]
@@ -112,30 +416,66 @@ func (s *State) ConfigExists(name string) bool {
 }
 
 // AddConfig adds a configuration to the state.
-func (s *State) AddConfig(name, path, description string) error {
+func (s *State) AddConfig(name string, cfg EmacsConfig) error {
+	s.normalize()
 	if _, exists := s.Configs[name]; exists {
 		return errors.ConfigExistsError{Name: name}
 	}
 
-	s.Configs[name] = EmacsConfig{
-		InitDir:     path,
-		Description: description,
-	}
-	s.Context = name
+	cfg.CreatedAt = timestamp()
+	cfg.UpdatedAt = cfg.CreatedAt
+	s.Configs[name] = cfg
 	return nil
 }
 
-// RemoveConfig removes a configuration rom the state.
+// RemoveConfig removes a configuration from the state, clearing the active
+// context if it no longer resolves without it.
 func (s *State) RemoveConfig(name string) error {
 	if _, exists := s.Configs[name]; !exists {
 		return errors.ConfigNotFoundError{Name: name}
 	}
 
+	resolved := s.contextResolves()
 	delete(s.Configs, name)
-	s.Context = ""
+	if resolved && !s.contextResolves() {
+		s.switchContext("")
+	}
 	return nil
 }
 
+// RenameConfig renames a configuration, updating the environments using it.
+func (s *State) RenameConfig(name, newName string) error {
+	cfg, exists := s.Configs[name]
+	if !exists {
+		return errors.ConfigNotFoundError{Name: name}
+	}
+	if _, exists := s.Configs[newName]; exists {
+		return errors.ConfigExistsError{Name: newName}
+	}
+
+	delete(s.Configs, name)
+	cfg.UpdatedAt = timestamp()
+	s.Configs[newName] = cfg
+	for envName, environment := range s.Environments {
+		if environment.ConfigName == name {
+			environment.ConfigName = newName
+			s.Environments[envName] = environment
+		}
+	}
+	return nil
+}
+
+// ConfigReferences returns the sorted names of the environments using a configuration.
+func (s *State) ConfigReferences(name string) []string {
+	var names []string
+	for _, envName := range sortedKeys(s.Environments) {
+		if s.effectiveOrOwn(envName).ConfigName == name {
+			names = append(names, envName)
+		}
+	}
+	return names
+}
+
 // EnvironmentExists checks if an emacs environment exists in the state.
 func (s *State) EnvironmentExists(name string) bool {
 	_, exists := s.Environments[name]
@@ -143,74 +483,670 @@ func (s *State) EnvironmentExists(name string) bool {
 }
 
 // AddEnvironment adds an emacs environment to the state.
-func (s *State) AddEnvironment(name, command, config, description string) error {
+func (s *State) AddEnvironment(name string, environment Environment) error {
+	s.normalize()
 	if _, exists := s.Environments[name]; exists {
 		return errors.EnvironmentExistsError{Name: name}
 	}
-	if _, exists := s.Commands[name]; !exists {
-		return errors.CommandNotFoundError{Name: name}
-	}
-	if _, exists := s.Configs[name]; !exists {
-		return errors.ConfigNotFoundError{Name: name}
+	if err := s.checkEnvironment(name, environment); err != nil {
+		return err
 	}
 
-	s.Environments[name] = Environment{
-		CommandName: command,
-		ConfigName:  config,
-		Description: description,
+	environment.CreatedAt = timestamp()
+	environment.UpdatedAt = environment.CreatedAt
+	s.Environments[name] = environment
+	return nil
+}
+
+// UpdateEnvironment replaces an existing emacs environment in the state,
+// keeping when it was created.
+func (s *State) UpdateEnvironment(name string, environment Environment) error {
+	previous, exists := s.Environments[name]
+	if !exists {
+		return errors.EnvironmentNotFoundError{Name: name}
 	}
-	s.Context = name
+	if err := s.checkEnvironment(name, environment); err != nil {
+		return err
+	}
+
+	environment.CreatedAt = previous.CreatedAt
+	environment.UpdatedAt = timestamp()
+	s.Environments[name] = environment
 	return nil
 }
 
-// RemoveEnvironment removes an emacs environment from the state.
+// checkEnvironment checks that an environment would resolve if stored under a
+// name, leaving the state unchanged.
+func (s *State) checkEnvironment(name string, environment Environment) error {
+	previous, existed := s.Environments[name]
+	s.Environments[name] = environment
+	_, err := s.Resolve(name)
+	if existed {
+		s.Environments[name] = previous
+	} else {
+		delete(s.Environments, name)
+	}
+	return err
+}
+
+// EnvironmentReferences returns the sorted names of the environments directly
+// extending an environment.
+func (s *State) EnvironmentReferences(name string) []string {
+	var names []string
+	for _, envName := range sortedKeys(s.Environments) {
+		if s.Environments[envName].Extends == name {
+			names = append(names, envName)
+		}
+	}
+	return names
+}
+
+// Ancestors returns the names of the environments an environment extends,
+// nearest first. It fails if an ancestor does not exist or if the chain of
+// ancestors loops back on itself.
+func (s *State) Ancestors(name string) ([]string, error) {
+	environment, exists := s.Environments[name]
+	if !exists {
+		return nil, errors.EnvironmentNotFoundError{Name: name}
+	}
+
+	chain := []string{name}
+	for environment.Extends != "" {
+		parent := environment.Extends
+		chain = append(chain, parent)
+		if slices.Contains(chain[:len(chain)-1], parent) {
+			return nil, errors.EnvironmentCycleError{Chain: chain}
+		}
+		if environment, exists = s.Environments[parent]; !exists {
+			return nil, errors.EnvironmentNotFoundError{Name: parent}
+		}
+	}
+	return chain[1:], nil
+}
+
+// Effective returns an environment with the settings it inherits from its
+// ancestors, each taking precedence over those it extends.
+func (s *State) Effective(name string) (Environment, error) {
+	ancestors, err := s.Ancestors(name)
+	if err != nil {
+		return Environment{}, err
+	}
+	return s.effective(name, ancestors), nil
+}
+
+// effective returns an environment with the settings inherited from its ancestors.
+func (s *State) effective(name string, ancestors []string) Environment {
+	environment := s.Environments[name]
+	for _, ancestor := range ancestors {
+		environment = environment.inherit(s.Environments[ancestor])
+	}
+	return environment
+}
+
+// effectiveOrOwn returns the effective environment of an environment, or its
+// own settings if its ancestors cannot be resolved.
+func (s *State) effectiveOrOwn(name string) Environment {
+	if environment, err := s.Effective(name); err == nil {
+		return environment
+	}
+	return s.Environments[name]
+}
+
+// RemoveEnvironment removes an emacs environment from the state, clearing the
+// active context if it is the environment or no longer resolves without it.
 func (s *State) RemoveEnvironment(name string) error {
 	if _, exists := s.Environments[name]; !exists {
 		return errors.EnvironmentNotFoundError{Name: name}
 	}
 
+	resolved := s.contextResolves()
 	delete(s.Environments, name)
-	s.Context = ""
+	if s.Context == name || resolved && !s.contextResolves() {
+		s.switchContext("")
+	}
+	if s.Default == name {
+		s.Default = ""
+	}
 	return nil
 }
 
-// Load loads the application state from the state file.
-func Load(path string) (*State, error) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return New(), nil
+// contextResolves checks if the active context is set and resolves, so that
+// removals only clear it when they are what breaks it.
+func (s *State) contextResolves() bool {
+	if s.Context == "" {
+		return false
+	}
+	_, err := s.Resolve(s.Context)
+	return err == nil
+}
+
+// SetContext sets the active emacs environment context, or clears it if name
+// is empty, recording the previous context at the front of the context history.
+// Consecutive duplicates are not recorded, and the oldest entries are dropped
+// beyond MaxContextHistory entries.
+func (s *State) SetContext(name string) error {
+	if name != "" {
+		if _, exists := s.Environments[name]; !exists {
+			return errors.EnvironmentNotFoundError{Name: name}
+		}
 	}
 
-	file, err := os.Open(path)
+	s.switchContext(name)
+	return nil
+}
+
+// switchContext sets the active context without validating it, recording the
+// previous context in the context history.
+func (s *State) switchContext(name string) {
+	if s.Context != "" && s.Context != name && (len(s.ContextHistory) == 0 || s.ContextHistory[0] != s.Context) {
+		s.ContextHistory = append([]string{s.Context}, s.ContextHistory...)
+		if len(s.ContextHistory) > MaxContextHistory {
+			s.ContextHistory = s.ContextHistory[:MaxContextHistory]
+		}
+	}
+	s.Context = name
+}
+
+// PreviousContext returns the most recent context of the context history other
+// than the active context whose environment still exists.
+func (s *State) PreviousContext() (string, error) {
+	for _, name := range s.ContextHistory {
+		if _, exists := s.Environments[name]; exists && name != s.Context {
+			return name, nil
+		}
+	}
+	return "", errors.NoContextHistoryError
+}
+
+// SetDefault sets the default emacs environment used when there is no context.
+func (s *State) SetDefault(name string) error {
+	if _, exists := s.Environments[name]; !exists {
+		return errors.EnvironmentNotFoundError{Name: name}
+	}
+
+	s.Default = name
+	return nil
+}
+
+// Resolve resolves the command and configuration of an emacs environment in the state.
+func (s *State) Resolve(name string) (*ResolvedEnvironment, error) {
+	ancestors, err := s.Ancestors(name)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = file.Close() }()
+	env := s.effective(name, ancestors)
+
+	cmd, ok := s.Commands[env.CommandName]
+	if !ok {
+		return nil, errors.CommandNotFoundError{Name: env.CommandName}
+	}
+
+	cfg, ok := s.Configs[env.ConfigName]
+	if !ok {
+		return nil, errors.ConfigNotFoundError{Name: env.ConfigName}
+	}
+
+	return &ResolvedEnvironment{
+		Name:        name,
+		Environment: env,
+		Ancestors:   ancestors,
+		Command:     cmd,
+		Config:      cfg,
+	}, nil
+}
+
+// Validate checks that the state is internally consistent, returning an error
+// describing the first problem found.
+func (s *State) Validate() error {
+	for name, command := range s.Commands {
+		if command.BinPath == "" {
+			return errors.InvalidCommandError{Name: name}
+		}
+	}
+	for name, cfg := range s.Configs {
+		if cfg.InitDir == "" {
+			return errors.InvalidConfigError{Name: name}
+		}
+	}
+	for _, name := range sortedKeys(s.Environments) {
+		if _, err := s.Resolve(name); err != nil {
+			return err
+		}
+	}
+	if s.Context != "" {
+		if _, exists := s.Environments[s.Context]; !exists {
+			return errors.EnvironmentNotFoundError{Name: s.Context}
+		}
+	}
+	if s.Default != "" {
+		if _, exists := s.Environments[s.Default]; !exists {
+			return errors.EnvironmentNotFoundError{Name: s.Default}
+		}
+	}
+	return nil
+}
+
+// Prune removes environments that do not resolve, as they reference commands,
+// configurations, or parent environments that do not exist, or extend each
+// other in a cycle, then clears the context and default environment if they
+// reference an environment that does not exist. It returns a description of
+// each removal.
+func (s *State) Prune() []string {
+	var pruned []string
+	// Removing an environment may leave those extending it dangling in turn.
+	for removed := true; removed; {
+		removed = false
+		for _, name := range sortedKeys(s.Environments) {
+			if _, err := s.Resolve(name); err != nil {
+				delete(s.Environments, name)
+				pruned = append(pruned, "environment "+name)
+				removed = true
+			}
+		}
+	}
+	if s.Context != "" {
+		if _, exists := s.Environments[s.Context]; !exists {
+			pruned = append(pruned, "context "+s.Context)
+			s.switchContext("")
+		}
+	}
+	if s.Default != "" {
+		if _, exists := s.Environments[s.Default]; !exists {
+			pruned = append(pruned, "default "+s.Default)
+			s.Default = ""
+		}
+	}
+	return pruned
+}
+
+// SearchResult represents an entity of the state matching a search.
+type SearchResult struct {
+	Kind        string
+	Name        string
+	Description string
+}
+
+// Search returns the commands, configurations, and environments whose name or
+// description matches a term, case-insensitively. If regex is true, the term
+// is a regular expression, otherwise it is a substring.
+func (s *State) Search(term string, regex bool) ([]SearchResult, error) {
+	pattern := regexp.QuoteMeta(term)
+	if regex {
+		pattern = term
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, errors.InvalidPatternError{Pattern: term, Reason: err.Error()}
+	}
 
-	var state State
-	if err := json.NewDecoder(file).Decode(&state); err != nil {
+	var results []SearchResult
+	match := func(kind, name, description string) {
+		if re.MatchString(name) || re.MatchString(description) {
+			results = append(results, SearchResult{Kind: kind, Name: name, Description: description})
+		}
+	}
+	for _, name := range sortedKeys(s.Commands) {
+		match("command", name, s.Commands[name].Description)
+	}
+	for _, name := range sortedKeys(s.Configs) {
+		match("config", name, s.Configs[name].Description)
+	}
+	for _, name := range sortedKeys(s.Environments) {
+		match("environment", name, s.Environments[name].Description)
+	}
+	return results, nil
+}
+
+// MergeReport describes the changes made when merging one state into another.
+type MergeReport struct {
+	Added   []string
+	Renamed []string
+	Deduped []string
+	Skipped []string
+}
+
+// Merge merges the commands, configurations, and environments of another
+// state into the state. Entities identical to existing ones of the same name
+// are skipped, and entities conflicting with existing ones of the same name
+// are added under a new name. If dedup is true, commands and configurations
+// identical to existing ones of another name are not added, and environments
+// referencing them reference the existing ones instead.
+func (s *State) Merge(other *State, dedup bool) MergeReport {
+	var report MergeReport
+
+	commandNames := make(map[string]string, len(other.Commands))
+	for _, name := range sortedKeys(other.Commands) {
+		command := other.Commands[name]
+		existing, exists := s.Commands[name]
+		switch {
+		case exists && existing.Equal(command):
+			commandNames[name] = name
+			report.Skipped = append(report.Skipped, "command "+name)
+		case dedup && s.findCommand(command) != "":
+			commandNames[name] = s.findCommand(command)
+			report.Deduped = append(report.Deduped, "command "+name+" -> "+commandNames[name])
+		case exists:
+			commandNames[name] = uniqueName(s.Commands, name)
+			s.Commands[commandNames[name]] = command
+			report.Renamed = append(report.Renamed, "command "+name+" -> "+commandNames[name])
+		default:
+			commandNames[name] = name
+			s.Commands[name] = command
+			report.Added = append(report.Added, "command "+name)
+		}
+	}
+
+	configNames := make(map[string]string, len(other.Configs))
+	for _, name := range sortedKeys(other.Configs) {
+		cfg := other.Configs[name]
+		existing, exists := s.Configs[name]
+		switch {
+		case exists && existing.Equal(cfg):
+			configNames[name] = name
+			report.Skipped = append(report.Skipped, "config "+name)
+		case dedup && s.findConfig(cfg) != "":
+			configNames[name] = s.findConfig(cfg)
+			report.Deduped = append(report.Deduped, "config "+name+" -> "+configNames[name])
+		case exists:
+			configNames[name] = uniqueName(s.Configs, name)
+			s.Configs[configNames[name]] = cfg
+			report.Renamed = append(report.Renamed, "config "+name+" -> "+configNames[name])
+		default:
+			configNames[name] = name
+			s.Configs[name] = cfg
+			report.Added = append(report.Added, "config "+name)
+		}
+	}
+
+	environmentNames := make(map[string]string, len(other.Environments))
+	for _, name := range sortedKeys(other.Environments) {
+		environment := other.Environments[name]
+		if commandName, ok := commandNames[environment.CommandName]; ok {
+			environment.CommandName = commandName
+		}
+		if configName, ok := configNames[environment.ConfigName]; ok {
+			environment.ConfigName = configName
+		}
+		existing, exists := s.Environments[name]
+		switch {
+		case exists && existing.Equal(environment):
+			report.Skipped = append(report.Skipped, "environment "+name)
+		case exists:
+			environmentNames[name] = uniqueName(s.Environments, name)
+			s.Environments[environmentNames[name]] = environment
+			report.Renamed = append(report.Renamed, "environment "+name+" -> "+environmentNames[name])
+		default:
+			environmentNames[name] = name
+			s.Environments[name] = environment
+			report.Added = append(report.Added, "environment "+name)
+		}
+	}
+
+	// Environments added extend the added environments they extended, even if renamed.
+	for _, newName := range environmentNames {
+		environment := s.Environments[newName]
+		if parent, ok := environmentNames[environment.Extends]; ok {
+			environment.Extends = parent
+			s.Environments[newName] = environment
+		}
+	}
+	return report
+}
+
+// Delta lists the names of entities of one kind that differ between two states.
+type Delta struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// StateDiff describes the differences between two states.
+type StateDiff struct {
+	Commands     Delta  `json:"commands"`
+	Configs      Delta  `json:"configs"`
+	Environments Delta  `json:"environments"`
+	OldContext   string `json:"old_context,omitempty"`
+	NewContext   string `json:"new_context,omitempty"`
+	OldDefault   string `json:"old_default,omitempty"`
+	NewDefault   string `json:"new_default,omitempty"`
+}
+
+// Diff returns the differences from the state to another state, that is what
+// would change if the state were replaced by the other one.
+func (s *State) Diff(other *State) StateDiff {
+	return StateDiff{
+		Commands: diffMaps(s.Commands, other.Commands, func(a, b EmacsCommand) bool {
+			return a.Equal(b)
+		}),
+		Configs: diffMaps(s.Configs, other.Configs, func(a, b EmacsConfig) bool {
+			return a.Equal(b)
+		}),
+		Environments: diffMaps(s.Environments, other.Environments, func(a, b Environment) bool {
+			return a.Equal(b)
+		}),
+		OldContext: s.Context,
+		NewContext: other.Context,
+		OldDefault: s.Default,
+		NewDefault: other.Default,
+	}
+}
+
+// diffMaps returns the names of entities added, removed, or changed from one map to another.
+func diffMaps[V any](old, new map[string]V, equal func(a, b V) bool) Delta {
+	var delta Delta
+	for _, name := range sortedKeys(old) {
+		value, exists := new[name]
+		switch {
+		case !exists:
+			delta.Removed = append(delta.Removed, name)
+		case !equal(old[name], value):
+			delta.Changed = append(delta.Changed, name)
+		}
+	}
+	for _, name := range sortedKeys(new) {
+		if _, exists := old[name]; !exists {
+			delta.Added = append(delta.Added, name)
+		}
+	}
+	return delta
+}
+
+// findCommand returns the name of a command identical to the provided one, if any.
+func (s *State) findCommand(command EmacsCommand) string {
+	for _, name := range sortedKeys(s.Commands) {
+		if existing := s.Commands[name]; existing.Equal(command) {
+			return name
+		}
+	}
+	return ""
+}
+
+// findConfig returns the name of a configuration identical to the provided one, if any.
+func (s *State) findConfig(cfg EmacsConfig) string {
+	for _, name := range sortedKeys(s.Configs) {
+		if existing := s.Configs[name]; existing.Equal(cfg) {
+			return name
+		}
+	}
+	return ""
+}
+
+// timestamp returns the current time in RFC3339 format, as recorded when
+// entities are created or updated.
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// sortedKeys returns the keys of a map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// uniqueName returns a name based on the provided one that is not a key of the map.
+func uniqueName[V any](m map[string]V, name string) string {
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", name, i)
+		if _, exists := m[candidate]; !exists {
+			return candidate
+		}
+	}
+}
+
+// Load loads the application state from the state file, migrating it from
+// older versions of the state file format. If the state file does not exist,
+// a new state is returned using the emacs binary at binPath with the
+// configuration in initDir, as returned by New.
+func Load(path, binPath, initDir string) (*State, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return New(binPath, initDir), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
-	return &state, nil
+	return Migrate(data)
 }
 
 // Save saves the application state to the state file.
+//
+// The state is first written to a temporary file in the same directory and
+// then renamed over the state file, so that an interrupted save never leaves a
+// half-written state file behind. Any existing state file is copied to its
+// backup path before it is replaced.
 func Save(state *State, path string) error {
 	dir := filepath.Dir(path)
 	if err := util.EnsureDir(dir); err != nil {
 		return err
 	}
 
-	file, err := os.Create(path)
+	state.Version = CurrentVersion
+	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer func() { _ = file.Close() }()
 
-	data, err := json.MarshalIndent(state, "", "  ")
+	if err := Backup(path); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	tempPath := file.Name()
+	defer func() { _ = os.Remove(tempPath) }()
 
-	_, err = file.Write(data)
-	return err
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// LockTimeout is how long Lock waits for another process to release the state file lock.
+const LockTimeout = 5 * time.Second
+
+// LockPath returns the path of the lock file of the state file at path.
+func LockPath(path string) string {
+	return path + ".lock"
+}
+
+// Lock acquires an advisory lock on the state file at path by locking its
+// lock file, waiting up to timeout for another process holding it to release
+// it. The operating system releases the lock of a process that exits without
+// releasing it, so the lock file itself is left in place. It returns a
+// function releasing the lock.
+func Lock(path string, timeout time.Duration) (func() error, error) {
+	if err := util.EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	lockPath := LockPath(path)
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := util.TryLockFile(file)
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			_ = file.Close()
+			return nil, errors.StateLockedError{Path: lockPath}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Record the pid of the process holding the lock for anyone inspecting it.
+	if err := file.Truncate(0); err == nil {
+		_, _ = fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	return func() error {
+		err := util.UnlockFile(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// BackupPath returns the path of the backup file of the state file at path.
+func BackupPath(path string) string {
+	return path + ".bak"
+}
+
+// Restore swaps the state file at path with its backup file, so that a
+// subsequent restore undoes the previous one.
+func Restore(path string) error {
+	backupPath := BackupPath(path)
+	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
+		return errors.BackupNotFoundError{Path: backupPath}
+	}
+
+	// If there is no current state file, simply move the backup into place.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return os.Rename(backupPath, path)
+	}
+
+	// Otherwise, swap the state and backup files using a temporary name.
+	tempPath := path + ".swap"
+	if err := os.Rename(path, tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(backupPath, path); err != nil {
+		_ = os.Rename(tempPath, path)
+		return err
+	}
+	return os.Rename(tempPath, backupPath)
+}
+
+// Backup copies the state file at path, if any, to its backup path.
+func Backup(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(BackupPath(path), data, 0644)
 }
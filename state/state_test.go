@@ -0,0 +1,313 @@
+package state
+
+import (
+	"bufio"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	unlock, err := Lock(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lock(path, 0); !stderrors.As(err, new(errors.StateLockedError)) {
+		t.Errorf("second lock: err = %v, want StateLockedError", err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = Lock(path, 0)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	_ = unlock()
+}
+
+// TestLockHelper holds the lock of the state file named by the
+// EMACSCTL_TEST_LOCK environment variable until it is killed, when run by
+// TestLockHolderExits.
+func TestLockHelper(t *testing.T) {
+	path := os.Getenv("EMACSCTL_TEST_LOCK")
+	if path == "" {
+		t.Skip("run by TestLockHolderExits")
+	}
+	if _, err := Lock(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("locked")
+	time.Sleep(time.Minute)
+}
+
+func TestLockHolderExits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), "EMACSCTL_TEST_LOCK="+path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = cmd.Process.Kill() }()
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("helper printed %q, %v, want locked", line, err)
+	}
+
+	if _, err := Lock(path, 0); !stderrors.As(err, new(errors.StateLockedError)) {
+		t.Errorf("lock held by another process: err = %v, want StateLockedError", err)
+	}
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	unlock, err := Lock(path, 0)
+	if err != nil {
+		t.Fatalf("lock of process no longer running was not released: %v", err)
+	}
+	data, err := os.ReadFile(LockPath(path))
+	if err != nil || string(data) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("lock file = %q, %v, want pid %d", data, err, os.Getpid())
+	}
+	_ = unlock()
+}
+
+func TestLockLeftBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	for _, content := range []string{"", "1\n", "not a pid\n"} {
+		if err := os.WriteFile(LockPath(path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		unlock, err := Lock(path, 0)
+		if err != nil {
+			t.Errorf("lock file %q not held by any process: err = %v, want none", content, err)
+			continue
+		}
+		_ = unlock()
+	}
+}
+
+func TestLoadPartialState(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"empty object", `{}`},
+		{"missing maps", `{"version": 2}`},
+		{"null maps", `{"version": 2, "commands": null, "configs": null, "environments": null, "context": null}`},
+		{"missing context", `{"version": 2, "commands": {}, "configs": {}, "environments": {}}`},
+		{"null environments", `{"commands": {"emacs": {"bin_path": "emacs"}}, "environments": null, "context": "dev"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(path, []byte(tt.raw), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := Load(path, "emacs", "/home/user/.emacs.d")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddCommand("emacs30", []string{"/opt/emacs30/bin/emacs"}, nil, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddConfig("vanilla", EmacsConfig{InitDir: "/home/user/vanilla"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.AddEnvironment("vanilla", Environment{CommandName: "emacs30", ConfigName: "vanilla"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetContext("vanilla"); err != nil {
+				t.Fatal(err)
+			}
+			if env, err := s.Resolve("vanilla"); err != nil || env.Config.InitDir != "/home/user/vanilla" {
+				t.Errorf("resolve vanilla = %+v, %v, want the added config", env, err)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := New("emacs", "/home/user/.emacs.d")
+	if err := s.AddCommand("emacs29", []string{"/opt/emacs29/bin/emacs"}, nil, "Emacs 29 from source"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddConfig("doom", EmacsConfig{InitDir: "/home/user/doom", Description: "Doom Emacs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddEnvironment("work", Environment{CommandName: "emacs29", ConfigName: "doom", Description: "Work setup"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		term  string
+		regex bool
+		want  []string
+	}{
+		{"substring of name", "doo", false, []string{"config doom"}},
+		{"substring of description", "SETUP", false, []string{"environment work"}},
+		{"across kinds", "emacs", false, []string{"command default", "command emacs29", "config default", "config doom", "environment default"}},
+		{"metacharacters taken literally", "emacs.*", false, nil},
+		{"regex", "^(doom|work)$", true, []string{"config doom", "environment work"}},
+		{"case-insensitive regex", "EMACS\\d+", true, []string{"command emacs29"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := s.Search(tt.term, tt.regex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, result := range results {
+				got = append(got, result.Kind+" "+result.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Search(%q, %t) = %q, want %q", tt.term, tt.regex, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchBadPattern(t *testing.T) {
+	_, err := New("emacs", "/home/user/.emacs.d").Search("(unclosed", true)
+	var patternErr errors.InvalidPatternError
+	if !stderrors.As(err, &patternErr) || patternErr.Pattern != "(unclosed" {
+		t.Errorf("err = %v, want InvalidPatternError for (unclosed", err)
+	}
+}
+
+func TestAddKeepsContext(t *testing.T) {
+	s := New("emacs", "/home/user/.emacs.d")
+	adds := []struct {
+		name string
+		add  func() error
+	}{
+		{"AddCommand", func() error { return s.AddCommand("emacs29", []string{"/opt/emacs29/bin/emacs"}, nil, "") }},
+		{"AddCommandFrom", func() error { return s.AddCommandFrom("emacs29-nw", "emacs29", []string{"-nw"}, "") }},
+		{"AddConfig", func() error { return s.AddConfig("doom", EmacsConfig{InitDir: "/home/user/doom"}) }},
+		{"AddEnvironment", func() error { return s.AddEnvironment("doom", Environment{CommandName: "emacs29", ConfigName: "doom"}) }},
+	}
+	for _, tt := range adds {
+		if err := tt.add(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if s.Context != "default" || len(s.ContextHistory) > 0 {
+			t.Errorf("%s changed the context to %q with history %q", tt.name, s.Context, s.ContextHistory)
+		}
+	}
+}
+
+func TestZeroState(t *testing.T) {
+	s := &State{}
+	if err := s.AddCommand("emacs29", []string{"/opt/emacs29/bin/emacs", "-nw"}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddConfig("doom", EmacsConfig{InitDir: "/home/user/doom"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddEnvironment("doom", Environment{CommandName: "emacs29", ConfigName: "doom"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Commands) != 1 || len(s.Configs) != 1 || len(s.Environments) != 1 {
+		t.Errorf("zero state has %d commands, %d configs, %d environments after adding one of each",
+			len(s.Commands), len(s.Configs), len(s.Environments))
+	}
+	env, err := s.Resolve("doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := env.CommandLine(), []string{"/opt/emacs29/bin/emacs", "-nw", "--init-directory", "/home/user/doom"}; !slices.Equal(got, want) {
+		t.Errorf("command line = %q, want %q", got, want)
+	}
+}
+
+func TestRemoveClearsBrokenContext(t *testing.T) {
+	// newState returns a state with the context set to environment work using
+	// command emacs29 and config doom, and an unrelated environment other.
+	newState := func(t *testing.T) *State {
+		t.Helper()
+		s := New("emacs", "/home/user/.emacs.d")
+		steps := []error{
+			s.AddCommand("emacs29", []string{"/opt/emacs29/bin/emacs"}, nil, ""),
+			s.AddCommand("emacs30", []string{"/opt/emacs30/bin/emacs"}, nil, ""),
+			s.AddConfig("doom", EmacsConfig{InitDir: "/home/user/doom"}),
+			s.AddConfig("spacemacs", EmacsConfig{InitDir: "/home/user/spacemacs"}),
+			s.AddEnvironment("work", Environment{CommandName: "emacs29", ConfigName: "doom"}),
+			s.AddEnvironment("other", Environment{CommandName: "emacs30", ConfigName: "spacemacs"}),
+			s.SetContext("work"),
+		}
+		for _, err := range steps {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		remove func(s *State) error
+		want   string
+	}{
+		{"command of context", func(s *State) error { return s.RemoveCommand("emacs29") }, ""},
+		{"config of context", func(s *State) error { return s.RemoveConfig("doom") }, ""},
+		{"context environment", func(s *State) error { return s.RemoveEnvironment("work") }, ""},
+		{"unrelated command", func(s *State) error { return s.RemoveCommand("emacs30") }, "work"},
+		{"unrelated config", func(s *State) error { return s.RemoveConfig("spacemacs") }, "work"},
+		{"unrelated environment", func(s *State) error { return s.RemoveEnvironment("other") }, "work"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newState(t)
+			if err := tt.remove(s); err != nil {
+				t.Fatal(err)
+			}
+			if s.Context != tt.want {
+				t.Errorf("context = %q, want %q", s.Context, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveKeepsBrokenContext(t *testing.T) {
+	// A context already broken, such as by a hand edit, is not cleared by an
+	// unrelated removal.
+	s := New("emacs", "/home/user/.emacs.d")
+	if err := s.AddCommand("emacs30", []string{"/opt/emacs30/bin/emacs"}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	s.Context = "gone"
+	if err := s.RemoveCommand("emacs30"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Context != "gone" {
+		t.Errorf("context = %q, want gone", s.Context)
+	}
+}
+
+func TestNewTimestamps(t *testing.T) {
+	s := New("emacs", "/home/user/.emacs.d")
+	command, cfg, env := s.Commands["default"], s.Configs["default"], s.Environments["default"]
+	for kind, times := range map[string][2]string{
+		"command":     {command.CreatedAt, command.UpdatedAt},
+		"config":      {cfg.CreatedAt, cfg.UpdatedAt},
+		"environment": {env.CreatedAt, env.UpdatedAt},
+	} {
+		if _, err := time.Parse(time.RFC3339, times[0]); err != nil {
+			t.Errorf("default %s creation time %q: %v", kind, times[0], err)
+		}
+		if times[1] != times[0] {
+			t.Errorf("default %s update time = %q, want its creation time %q", kind, times[1], times[0])
+		}
+	}
+}
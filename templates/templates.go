@@ -0,0 +1,38 @@
+// Package templates provides the git repository URLs of well-known emacs starter kits.
+package templates
+
+import (
+	"sort"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+// urls maps the names of well-known emacs starter kits to their canonical git repository URLs.
+var urls = map[string]string{
+	"centaur":   "https://github.com/seagle0128/.emacs.d",
+	"crafted":   "https://github.com/SystemCrafters/crafted-emacs",
+	"doom":      "https://github.com/doomemacs/doomemacs",
+	"prelude":   "https://github.com/bbatsov/prelude",
+	"purcell":   "https://github.com/purcell/emacs.d",
+	"scimax":    "https://github.com/jkitchin/scimax",
+	"spacemacs": "https://github.com/syl20bnr/spacemacs",
+}
+
+// Names returns the sorted names of all known templates.
+func Names() []string {
+	names := make([]string, 0, len(urls))
+	for name := range urls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// URL returns the git repository URL of a known template.
+func URL(name string) (string, error) {
+	url, exists := urls[name]
+	if !exists {
+		return "", errors.TemplateNotFoundError{Name: name, Available: Names()}
+	}
+	return url, nil
+}
@@ -0,0 +1,500 @@
+package toml
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+// parser parses a TOML document into maps of values.
+type parser struct {
+	data  string
+	pos   int
+	line  int
+	root  map[string]any
+	table map[string]any
+}
+
+// parse parses a TOML document into a map of string, int64, float64, bool,
+// []any, and map[string]any values. Dates and times are kept as strings, as
+// are inf and nan floats, which JSON cannot represent.
+func parse(data []byte) (map[string]any, error) {
+	if !utf8.Valid(data) {
+		return nil, errors.InvalidTOMLError{Reason: "document is not valid UTF-8"}
+	}
+	root := map[string]any{}
+	p := &parser{data: string(data), line: 1, root: root, table: root}
+	for {
+		p.skipBlank(true)
+		if p.eof() {
+			return root, nil
+		}
+		var err error
+		if p.peek() == '[' {
+			err = p.parseHeader()
+		} else {
+			err = p.parseKeyValue(p.table)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// errorf returns an error at the current line of the document.
+func (p *parser) errorf(format string, args ...any) error {
+	return errors.InvalidTOMLError{Line: p.line, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+// next consumes the next byte, counting lines.
+func (p *parser) next() byte {
+	c := p.data[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipBlank skips spaces, tabs, and comments, and newlines too if requested.
+func (p *parser) skipBlank(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.next()
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		case newlines && (c == '\n' || c == '\r'):
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+// endLine consumes the rest of a line, which must be blank.
+func (p *parser) endLine() error {
+	p.skipBlank(false)
+	if p.eof() {
+		return nil
+	}
+	if strings.HasPrefix(p.data[p.pos:], "\r\n") {
+		p.next()
+	}
+	if p.peek() != '\n' {
+		return p.errorf("expected end of line")
+	}
+	p.next()
+	return nil
+}
+
+// parseHeader parses a table or array of tables header and makes the table it
+// defines the current table.
+func (p *parser) parseHeader() error {
+	p.next()
+	array := p.peek() == '['
+	if array {
+		p.next()
+	}
+	p.skipBlank(false)
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	if !strings.HasPrefix(p.data[p.pos:], closing) {
+		return p.errorf("expected %s", closing)
+	}
+	p.pos += len(closing)
+
+	table, err := p.descend(p.root, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if array {
+		existing, exists := table[last]
+		elements, ok := existing.([]any)
+		if exists && !ok {
+			return p.errorf("key %q is not an array of tables", last)
+		}
+		p.table = map[string]any{}
+		table[last] = append(elements, p.table)
+		return nil
+	}
+	p.table, err = p.descend(table, keys[len(keys)-1:])
+	return err
+}
+
+// descend returns the table at a path of keys below a table, creating any
+// missing tables. Keys of arrays of tables descend into their last element.
+func (p *parser) descend(table map[string]any, keys []string) (map[string]any, error) {
+	for _, key := range keys {
+		switch value := table[key].(type) {
+		case nil:
+			sub := map[string]any{}
+			table[key] = sub
+			table = sub
+		case map[string]any:
+			table = value
+		case []any:
+			last, ok := value[len(value)-1].(map[string]any)
+			if !ok {
+				return nil, p.errorf("key %q is not a table", key)
+			}
+			table = last
+		default:
+			return nil, p.errorf("key %q is not a table", key)
+		}
+	}
+	return table, nil
+}
+
+// parseKeyValue parses a key = value pair into a table.
+func (p *parser) parseKeyValue(table map[string]any) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	if p.peek() != '=' {
+		return p.errorf("expected =")
+	}
+	p.next()
+	p.skipBlank(false)
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	table, err = p.descend(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, exists := table[last]; exists {
+		return p.errorf("duplicate key %q", last)
+	}
+	table[last] = value
+	return nil
+}
+
+// parseKey parses a dotted key of bare and quoted keys.
+func (p *parser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		var key string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case c == '\'':
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.next()
+			}
+			if p.pos == start {
+				return nil, p.errorf("expected key")
+			}
+			key = p.data[start:p.pos]
+		}
+		keys = append(keys, key)
+		p.skipBlank(false)
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.next()
+		p.skipBlank(false)
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// parseValue parses a value.
+func (p *parser) parseValue() (any, error) {
+	switch c := p.peek(); c {
+	case '"':
+		if strings.HasPrefix(p.data[p.pos:], `"""`) {
+			return p.parseMultilineString(`"""`, true)
+		}
+		return p.parseBasicString()
+	case '\'':
+		if strings.HasPrefix(p.data[p.pos:], `'''`) {
+			return p.parseMultilineString(`'''`, false)
+		}
+		return p.parseLiteralString()
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	case 0:
+		return nil, p.errorf("expected value")
+	default:
+		return p.parseScalar()
+	}
+}
+
+// parseBasicString parses a double-quoted string with escapes.
+func (p *parser) parseBasicString() (string, error) {
+	p.next()
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		switch c := p.next(); c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// parseEscape parses the escape sequence following a backslash.
+func (p *parser) parseEscape(b *strings.Builder) error {
+	if p.eof() {
+		return p.errorf("unterminated string")
+	}
+	switch c := p.next(); c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.data) {
+			return p.errorf("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(p.data[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return p.errorf("invalid unicode escape")
+		}
+		p.pos += size
+		b.WriteRune(rune(code))
+	default:
+		return p.errorf("invalid escape sequence")
+	}
+	return nil
+}
+
+// parseLiteralString parses a single-quoted string without escapes.
+func (p *parser) parseLiteralString() (string, error) {
+	p.next()
+	end := strings.IndexAny(p.data[p.pos:], "'\n")
+	if end < 0 || p.data[p.pos+end] != '\'' {
+		return "", p.errorf("unterminated string")
+	}
+	s := p.data[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+// parseMultilineString parses a string between triple delimiters, with
+// escapes and line ending backslashes if it is a basic string.
+func (p *parser) parseMultilineString(delim string, basic bool) (string, error) {
+	p.pos += len(delim)
+	// A newline immediately following the opening delimiter is trimmed.
+	if strings.HasPrefix(p.data[p.pos:], "\r\n") {
+		p.next()
+	}
+	if p.peek() == '\n' {
+		p.next()
+	}
+
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		if strings.HasPrefix(p.data[p.pos:], delim) {
+			// Up to two quotes may precede the closing delimiter.
+			for strings.HasPrefix(p.data[p.pos+1:], delim) {
+				b.WriteByte(p.next())
+			}
+			p.pos += len(delim)
+			return b.String(), nil
+		}
+		c := p.next()
+		if !basic || c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		// A line ending backslash trims all whitespace up to the next non-whitespace.
+		rest := strings.TrimLeft(p.data[p.pos:], " \t")
+		if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+			for !p.eof() && strings.ContainsRune(" \t\r\n", rune(p.peek())) {
+				p.next()
+			}
+			continue
+		}
+		if err := p.parseEscape(&b); err != nil {
+			return "", err
+		}
+	}
+}
+
+// parseArray parses an array, which may span multiple lines.
+func (p *parser) parseArray() ([]any, error) {
+	p.next()
+	array := []any{}
+	for {
+		p.skipBlank(true)
+		if p.peek() == ']' {
+			p.next()
+			return array, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+		p.skipBlank(true)
+		switch p.peek() {
+		case ',':
+			p.next()
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+// parseInlineTable parses an inline table, which must fit on one line.
+func (p *parser) parseInlineTable() (map[string]any, error) {
+	p.next()
+	table := map[string]any{}
+	p.skipBlank(false)
+	if p.peek() == '}' {
+		p.next()
+		return table, nil
+	}
+	for {
+		p.skipBlank(false)
+		if err := p.parseKeyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipBlank(false)
+		switch p.peek() {
+		case ',':
+			p.next()
+		case '}':
+			p.next()
+			return table, nil
+		default:
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// parseScalar parses a boolean, number, or date and time.
+func (p *parser) parseScalar() (any, error) {
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", rune(p.peek())) {
+		p.next()
+	}
+	token := p.data[start:p.pos]
+	// A date may be followed by a time after a space.
+	if isDate(token) && p.pos+1 < len(p.data) && p.data[p.pos] == ' ' && isDigit(p.data[p.pos+1]) {
+		p.next()
+		for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", rune(p.peek())) {
+			p.next()
+		}
+		token = p.data[start:p.pos]
+	}
+
+	switch {
+	case token == "":
+		return nil, p.errorf("expected value")
+	case token == "true":
+		return true, nil
+	case token == "false":
+		return false, nil
+	case isDate(token) || len(token) >= 5 && isDigit(token[0]) && token[2] == ':':
+		return token, nil
+	case slices.Contains(specialFloats, token):
+		return token, nil
+	}
+	if integerPattern.MatchString(token) {
+		if i, err := strconv.ParseInt(token, 0, 64); err == nil {
+			return i, nil
+		}
+		return nil, p.errorf("integer out of range %q", token)
+	}
+	if floatPattern.MatchString(token) {
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(token, "_", ""), 64); err == nil {
+			return f, nil
+		}
+		return nil, p.errorf("float out of range %q", token)
+	}
+	return nil, p.errorf("invalid value %q", token)
+}
+
+// integerPattern matches decimal integers without leading zeros, and unsigned
+// hexadecimal, octal, and binary integers, with underscores between digits.
+var integerPattern = regexp.MustCompile(`^([+-]?(0|[1-9](_?[0-9])*)|0x[0-9A-Fa-f](_?[0-9A-Fa-f])*|0o[0-7](_?[0-7])*|0b[01](_?[01])*)$`)
+
+// floatPattern matches decimal floats with a fractional part, an exponent, or
+// both, with underscores between digits.
+var floatPattern = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)(\.[0-9](_?[0-9])*)?([eE][+-]?[0-9](_?[0-9])*)?$`)
+
+// specialFloats are the infinity and not a number float values.
+var specialFloats = []string{"inf", "+inf", "-inf", "nan", "+nan", "-nan"}
+
+// isDate checks if a token starts with a date.
+func isDate(token string) bool {
+	return len(token) >= 10 && isDigit(token[0]) && token[4] == '-' && token[7] == '-'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,218 @@
+package toml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// object is a JSON object keeping the order of its keys.
+type object struct {
+	keys   []string
+	values map[string]any
+}
+
+// decodeJSON decodes the next JSON value of a decoder using json.Number for
+// numbers and *object for objects, so that the order of keys is kept.
+func decodeJSON(dec *json.Decoder) (any, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		obj := &object{values: map[string]any{}}
+		for dec.More() {
+			keyToken, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyToken.(string)
+			value, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj.keys = append(obj.keys, key)
+			obj.values[key] = value
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		array := []any{}
+		for dec.More() {
+			value, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := dec.Token()
+		return array, err
+	default:
+		return token, nil
+	}
+}
+
+// encoder writes a TOML document.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+// table writes the keys of an object as the table at a path, or as an element
+// of the array of tables at a path, followed by its subtables and arrays of
+// tables.
+func (e *encoder) table(path []string, obj *object, arrayElement bool) {
+	var plain, nested []string
+	for _, key := range obj.keys {
+		switch value := obj.values[key]; {
+		case value == nil:
+		case isTable(value) || isArrayOfTables(value):
+			nested = append(nested, key)
+		default:
+			plain = append(plain, key)
+		}
+	}
+
+	// Tables without keys of their own are implied by their subtables.
+	switch {
+	case arrayElement:
+		e.header("[[", path, "]]")
+	case path != nil && (len(plain) > 0 || len(nested) == 0):
+		e.header("[", path, "]")
+	}
+	for _, key := range plain {
+		fmt.Fprintf(&e.buf, "%s = %s\n", encodeKey(key), encodeValue(obj.values[key]))
+	}
+
+	for _, key := range nested {
+		subpath := append(path[:len(path):len(path)], key)
+		switch value := obj.values[key].(type) {
+		case *object:
+			e.table(subpath, value, false)
+		case []any:
+			for _, element := range value {
+				e.table(subpath, element.(*object), true)
+			}
+		}
+	}
+}
+
+// header writes a table header for a path between delimiters, separated from
+// the previous content by a blank line.
+func (e *encoder) header(open string, path []string, close string) {
+	if e.buf.Len() > 0 {
+		e.buf.WriteString("\n")
+	}
+	e.buf.WriteString(open + joinKeys(path) + close + "\n")
+}
+
+// isTable checks if a value is written as a table.
+func isTable(value any) bool {
+	_, ok := value.(*object)
+	return ok
+}
+
+// isArrayOfTables checks if a value is a non-empty array of objects, written
+// as an array of tables.
+func isArrayOfTables(value any) bool {
+	array, ok := value.([]any)
+	if !ok || len(array) == 0 {
+		return false
+	}
+	for _, element := range array {
+		if !isTable(element) {
+			return false
+		}
+	}
+	return true
+}
+
+// bareKey matches keys that need no quoting.
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// encodeKey returns a key, quoted unless it is a bare key.
+func encodeKey(key string) string {
+	if bareKey.MatchString(key) {
+		return key
+	}
+	return encodeString(key)
+}
+
+// joinKeys returns the dotted key of a path.
+func joinKeys(path []string) string {
+	keys := make([]string, len(path))
+	for i, key := range path {
+		keys[i] = encodeKey(key)
+	}
+	return strings.Join(keys, ".")
+}
+
+// encodeValue returns the inline representation of a value.
+func encodeValue(value any) string {
+	switch value := value.(type) {
+	case string:
+		return encodeString(value)
+	case json.Number:
+		return value.String()
+	case bool:
+		if value {
+			return "true"
+		}
+		return "false"
+	case []any:
+		elements := make([]string, 0, len(value))
+		for _, element := range value {
+			if element != nil {
+				elements = append(elements, encodeValue(element))
+			}
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *object:
+		pairs := make([]string, 0, len(value.keys))
+		for _, key := range value.keys {
+			if value.values[key] != nil {
+				pairs = append(pairs, encodeKey(key)+" = "+encodeValue(value.values[key]))
+			}
+		}
+		if len(pairs) == 0 {
+			return "{}"
+		}
+		return "{ " + strings.Join(pairs, ", ") + " }"
+	default:
+		return encodeString(fmt.Sprint(value))
+	}
+}
+
+// encodeString returns a string as a TOML basic string.
+func encodeString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
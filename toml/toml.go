@@ -0,0 +1,53 @@
+// Package toml provides encoding and decoding of values as TOML documents.
+//
+// Values are converted through their JSON representation, so that the json
+// struct tags drive field names, omitempty, and custom marshaling in both
+// formats alike.
+package toml
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+// Marshal returns the TOML document of a value, which must encode to a JSON
+// object. Fields are written in the order of their JSON encoding, with nested
+// objects written as tables and arrays of objects as arrays of tables. Null
+// values are omitted, as TOML has no representation of them.
+func Marshal(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	value, err := decodeJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := value.(*object)
+	if !ok {
+		return nil, errors.InvalidTOMLError{Reason: "top-level value must be a table"}
+	}
+
+	var e encoder
+	e.table(nil, root, false)
+	return e.buf.Bytes(), nil
+}
+
+// Unmarshal parses a TOML document and stores the result in the value pointed
+// to by v, as encoding/json would store the equivalent JSON document. Dates and
+// times, and inf and nan floats, are stored as strings.
+func Unmarshal(data []byte, v any) error {
+	doc, err := parse(data)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonData, v)
+}
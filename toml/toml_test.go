@@ -0,0 +1,211 @@
+package toml
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mojochao/emacsctl/errors"
+	"github.com/mojochao/emacsctl/state"
+)
+
+func TestMarshalUnmarshalState(t *testing.T) {
+	s := state.New("emacs", "/home/user/.emacs.d")
+	if err := s.AddCommand("emacs29", []string{"/opt/emacs29/bin/emacs", "-nw"}, nil, `Emacs "29" from C:\src`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddConfig("doom", state.EmacsConfig{InitDir: "/home/user/doom", URL: "https://github.com/doomemacs/doomemacs", Description: "Doom\nEmacs"}); err != nil {
+		t.Fatal(err)
+	}
+	env := state.Environment{
+		CommandName: "emacs29",
+		ConfigName:  "doom",
+		Description: "Work setup",
+		Env:         map[string]string{"LANG": "C", "has space": "tab\there"},
+	}
+	if err := s.AddEnvironment("work.project", env); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetContext("work.project"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded state.State
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal of\n%s\nfailed: %v", data, err)
+	}
+	want, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("round trip through\n%s\ngave %s, want %s", data, got, want)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	type entry struct {
+		Name string `json:"name"`
+	}
+	value := struct {
+		Quoted  string            `json:"quoted"`
+		Spaced  string            `json:"a key"`
+		Skipped *string           `json:"skipped"`
+		Ints    []int             `json:"ints"`
+		Inline  []map[string]int  `json:"inline"`
+		Table   map[string]string `json:"table"`
+		Entries []entry           `json:"entries"`
+	}{
+		Quoted:  "say \"hi\"\\\n\x01",
+		Spaced:  "é",
+		Ints:    []int{1, 2},
+		Inline:  []map[string]int{},
+		Table:   map[string]string{"dotted.key": "v"},
+		Entries: []entry{{"a"}, {"b"}},
+	}
+	want := `quoted = "say \"hi\"\\\n\u0001"
+"a key" = "é"
+ints = [1, 2]
+inline = []
+
+[table]
+"dotted.key" = "v"
+
+[[entries]]
+name = "a"
+
+[[entries]]
+name = "b"
+`
+	data, err := Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want map[string]any
+	}{
+		{
+			name: "escaped strings",
+			doc:  `s = "tab\there \"quoted\" \\ \u00e9 \U0001F600"` + "\n" + `l = 'C:\path'`,
+			want: map[string]any{"s": "tab\there \"quoted\" \\ é 😀", "l": `C:\path`},
+		},
+		{
+			name: "multiline strings",
+			doc:  "s = \"\"\"\none \\\n    two\"\"\"\nl = '''\nraw \\n'''",
+			want: map[string]any{"s": "one two", "l": "raw \\n"},
+		},
+		{
+			name: "quoted keys",
+			doc:  `"a.b" = 1` + "\n" + `'c d' = 2` + "\n" + `x."y.z" = 3`,
+			want: map[string]any{"a.b": 1.0, "c d": 2.0, "x": map[string]any{"y.z": 3.0}},
+		},
+		{
+			name: "inline tables",
+			doc:  `t = { a = 1, b = { c = "d" }, e = [] }` + "\n" + `empty = {}`,
+			want: map[string]any{"t": map[string]any{"a": 1.0, "b": map[string]any{"c": "d"}, "e": []any{}}, "empty": map[string]any{}},
+		},
+		{
+			name: "arrays of tables",
+			doc:  "[[env]]\nname = \"a\"\n\n[[env]]\nname = \"b\"\n\n[env.vars]\nk = \"v\"\n",
+			want: map[string]any{"env": []any{
+				map[string]any{"name": "a"},
+				map[string]any{"name": "b", "vars": map[string]any{"k": "v"}},
+			}},
+		},
+		{
+			name: "numbers",
+			doc:  "i = 1_000\nh = 0xff\no = 0o17\nb = 0b101\nn = -17\nf = 6.5e2\ng = -1_0.2_5\nz = 0.0",
+			want: map[string]any{"i": 1000.0, "h": 255.0, "o": 15.0, "b": 5.0, "n": -17.0, "f": 650.0, "g": -10.25, "z": 0.0},
+		},
+		{
+			name: "special floats",
+			doc:  "f = [inf, +inf, -inf, nan, -nan]",
+			want: map[string]any{"f": []any{"inf", "+inf", "-inf", "nan", "-nan"}},
+		},
+		{
+			name: "dates and booleans",
+			doc:  "d = 1979-05-27T07:32:00Z\nl = 1979-05-27 07:32:00\nt = 07:32:00\nb = [true, false]",
+			want: map[string]any{"d": "1979-05-27T07:32:00Z", "l": "1979-05-27 07:32:00", "t": "07:32:00", "b": []any{true, false}},
+		},
+		{
+			name: "comments and line endings",
+			doc:  "# comment\r\na = 1 # trailing\r\n\r\n[t] # table\r\nb = [\r\n  1, # one\r\n  2,\r\n]\r\n",
+			want: map[string]any{"a": 1.0, "t": map[string]any{"b": []any{1.0, 2.0}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			if err := Unmarshal([]byte(tt.doc), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		line   int
+		reason string
+	}{
+		{"duplicate key", "a = 1\nb = 2\na = 3", 3, `duplicate key "a"`},
+		{"duplicate dotted key", "a.b = 1\n\na.b = 2", 3, `duplicate key "b"`},
+		{"duplicate inline table key", "t = { a = 1, a = 2 }", 1, `duplicate key "a"`},
+		{"duplicate table key", "[t]\na = 1\n[t]\na = 2", 4, `duplicate key "a"`},
+		{"value redefined as table", "a = 1\n[a]", 2, `key "a" is not a table`},
+		{"table redefined as array of tables", "[a]\n[[a]]", 2, `key "a" is not an array of tables`},
+		{"unterminated string", "a = 1\ns = \"open\n", 2, "unterminated string"},
+		{"invalid escape", `s = "\q"`, 1, "invalid escape sequence"},
+		{"invalid value", "a = 1\n\n\nb = yes", 4, `invalid value "yes"`},
+		{"leading zero", "n = 012", 1, `invalid value "012"`},
+		{"leading zero float", "f = 01.5", 1, `invalid value "01.5"`},
+		{"bare fraction", "f = .5", 1, `invalid value ".5"`},
+		{"bare point", "f = 1.", 1, `invalid value "1."`},
+		{"misplaced underscore", "n = 1__000", 1, `invalid value "1__000"`},
+		{"signed hex", "n = +0xff", 1, `invalid value "+0xff"`},
+		{"hex float", "f = 0x1p-2", 1, `invalid value "0x1p-2"`},
+		{"integer out of range", "n = 9223372036854775808", 1, `integer out of range`},
+		{"capitalized inf", "f = Inf", 1, `invalid value "Inf"`},
+		{"missing equals", "a 1", 1, "expected ="},
+		{"missing value", "a =", 1, "expected value"},
+		{"trailing content", "a = 1 b = 2", 1, "expected end of line"},
+		{"unclosed header", "[a\nb = 1", 1, "expected ]"},
+		{"unclosed array", "a = [1, 2\nb = 3", 2, "expected , or ] in array"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			err := Unmarshal([]byte(tt.doc), &got)
+			var tomlErr errors.InvalidTOMLError
+			if !stderrors.As(err, &tomlErr) {
+				t.Fatalf("err = %v, want InvalidTOMLError", err)
+			}
+			if tomlErr.Line != tt.line || !strings.Contains(tomlErr.Reason, tt.reason) {
+				t.Errorf("err = %v, want line %d: %s", err, tt.line, tt.reason)
+			}
+		})
+	}
+}
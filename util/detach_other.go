@@ -0,0 +1,8 @@
+//go:build !unix
+
+package util
+
+import "os/exec"
+
+// setDetached is a no-op on platforms without process sessions.
+func setDetached(_ *exec.Cmd) {}
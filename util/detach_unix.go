@@ -0,0 +1,14 @@
+//go:build unix
+
+package util
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setDetached configures a command to run in its own session, so that it is
+// not killed when the controlling terminal is closed.
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package util
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStartDetached(t *testing.T) {
+	done := filepath.Join(t.TempDir(), "done")
+	cmd := exec.Command("sh", "-c", `touch "$0"`, done)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := StartDetached(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil {
+		t.Error("standard streams of detached command not connected to the null device")
+	}
+	if cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setsid {
+		t.Error("detached command not started in its own session")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(done); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("detached command did not run")
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build unix && !aix && !solaris
+
+package util
+
+import (
+	stderrors "errors"
+	"os"
+	"syscall"
+)
+
+// TryLockFile tries to acquire an exclusive advisory lock on an open file,
+// reporting whether it did. The operating system releases the lock when the
+// file is closed, including when its process exits.
+func TryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if stderrors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UnlockFile releases a lock acquired with TryLockFile.
+func UnlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
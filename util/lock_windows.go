@@ -0,0 +1,24 @@
+package util
+
+import (
+	stderrors "errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// TryLockFile tries to acquire an exclusive advisory lock on an open file,
+// reporting whether it did. The operating system releases the lock when the
+// file is closed, including when its process exits.
+func TryLockFile(file *os.File) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, new(windows.Overlapped))
+	if stderrors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// UnlockFile releases a lock acquired with TryLockFile.
+func UnlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, new(windows.Overlapped))
+}
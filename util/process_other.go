@@ -0,0 +1,13 @@
+//go:build !unix
+
+package util
+
+import "os/exec"
+
+// ExitCode returns the exit code of a process that failed, or 1 if it has none.
+func ExitCode(err *exec.ExitError) int {
+	if code := err.ExitCode(); code >= 0 {
+		return code
+	}
+	return 1
+}
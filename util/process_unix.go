@@ -0,0 +1,17 @@
+//go:build unix
+
+package util
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ExitCode returns the exit code of a process that failed, which is 128 plus
+// the signal number for a process killed by a signal, like a shell reports.
+func ExitCode(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return err.ExitCode()
+}
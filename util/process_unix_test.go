@@ -0,0 +1,29 @@
+//go:build unix
+
+package util
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		script string
+		want   int
+	}{
+		{"exit 3", 3},
+		{"kill -TERM $$", 143},
+		{"kill -KILL $$", 137},
+	}
+	for _, tt := range tests {
+		err := exec.Command("sh", "-c", tt.script).Run()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("%s: err = %v, want an exit error", tt.script, err)
+		}
+		if got := ExitCode(exitErr); got != tt.want {
+			t.Errorf("%s: exit code = %d, want %d", tt.script, got, tt.want)
+		}
+	}
+}
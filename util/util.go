@@ -2,18 +2,124 @@
 package util
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
+
+	"github.com/mattn/go-isatty"
+
+	"github.com/mojochao/emacsctl/errors"
 )
 
-// EnsureDir ensures directory exists.
+// EmacsInstall represents an emacs binary installed on the system.
+type EmacsInstall struct {
+	Path    string
+	Version string
+}
+
+// emacsInstallPaths are common emacs install locations that may not be on PATH.
+var emacsInstallPaths = []string{
+	"/Applications/Emacs.app/Contents/MacOS/Emacs",
+	"/opt/homebrew/bin/emacs",
+	"/usr/local/bin/emacs",
+	"/snap/bin/emacs",
+	"/var/lib/flatpak/exports/bin/org.gnu.emacs",
+}
+
+// EnsureDir ensures directory exists, failing if something else exists at its path.
 func EnsureDir(path string) error {
-	_, err := os.Stat(path)
-	if !os.IsNotExist(err) {
-		return nil
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(path, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.NotADirectoryError{Path: path}
+	}
+	return nil
+}
+
+// StartDetached starts a command detached from the terminal with its standard
+// streams connected to the null device, and returns without waiting for it.
+func StartDetached(cmd *exec.Cmd) error {
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	setDetached(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// FormatSize formats a size in bytes for display, using binary unit prefixes.
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseKeyValues parses KEY=VALUE strings into a map, returning an error
+// naming the flag they were provided with for any malformed string.
+func ParseKeyValues(flag string, values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	pairs := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, errors.InvalidValueError{Name: flag, Value: value}
+		}
+		pairs[key] = val
+	}
+	return pairs, nil
+}
+
+// ParseEnvFile parses a dotenv-style file of KEY=VALUE lines into a map,
+// ignoring blank lines and # comments. Lines may start with export, and values
+// may be wrapped in matching single or double quotes, which are removed.
+func ParseEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errors.EnvFileNotFoundError{Path: path}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, errors.InvalidEnvFileError{Path: path, Line: i + 1, Text: line}
+		}
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		pairs[key] = val
 	}
-	return os.MkdirAll(path, 0755)
+	return pairs, nil
 }
 
 // GetBuildInfo returns the build information for the application.
@@ -34,3 +140,100 @@ func GetBuildInfo() map[string]string {
 func IsGitURL(input string) bool {
 	return strings.HasPrefix(input, "git@") || strings.HasPrefix(input, "https://")
 }
+
+// Confirm prompts the user with a yes or no question and returns true if they answer yes.
+func Confirm(prompt string) bool {
+	fmt.Printf("%s [y/N]: ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// IsInteractive checks if standard input is connected to a terminal.
+func IsInteractive() bool {
+	return IsTerminal(os.Stdin)
+}
+
+// IsTerminal checks if a file is connected to a terminal. Character devices
+// other than terminals, like /dev/null, are not.
+func IsTerminal(file *os.File) bool {
+	return isatty.IsTerminal(file.Fd()) || isatty.IsCygwinTerminal(file.Fd())
+}
+
+// Prompt prompts the user for a value, returning the default value if they enter nothing.
+func Prompt(prompt, defaultValue string) (string, error) {
+	fmt.Printf("%s [%s]: ", prompt, defaultValue)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return defaultValue, nil
+	}
+	return answer, nil
+}
+
+// Choose prompts the user to pick one of the options by number and returns its index.
+func Choose(prompt string, options []string) (int, error) {
+	for i, option := range options {
+		fmt.Printf("%d) %s\n", i+1, option)
+	}
+	fmt.Printf("%s [1-%d]: ", prompt, len(options))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || choice < 1 || choice > len(options) {
+		return 0, fmt.Errorf("invalid choice: %s", strings.TrimSpace(answer))
+	}
+	return choice - 1, nil
+}
+
+// DetectEmacsBinaries returns the emacs binaries found on PATH and in common
+// install locations, in that order and without duplicates, running them with
+// run to find their versions.
+func DetectEmacsBinaries(run func(cmd *exec.Cmd) error) []EmacsInstall {
+	var candidates []string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir != "" {
+			candidates = append(candidates, filepath.Join(dir, "emacs"))
+		}
+	}
+	candidates = append(candidates, emacsInstallPaths...)
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(homeDir, ".local/share/flatpak/exports/bin/org.gnu.emacs"))
+	}
+
+	var installs []EmacsInstall
+	seen := make(map[string]bool)
+	for _, path := range candidates {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil || seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+		installs = append(installs, EmacsInstall{Path: path, Version: EmacsVersion(run, path)})
+	}
+	return installs
+}
+
+// EmacsVersion returns the first line of the version output of an emacs
+// binary, running it with run.
+func EmacsVersion(run func(cmd *exec.Cmd) error, path string) string {
+	var output strings.Builder
+	cmd := exec.Command(path, "--version")
+	cmd.Stdout = &output
+	if err := run(cmd); err != nil {
+		return "unknown"
+	}
+	line, _, _ := strings.Cut(output.String(), "\n")
+	return strings.TrimSpace(line)
+}
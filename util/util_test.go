@@ -0,0 +1,70 @@
+package util
+
+import (
+	stderrors "errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mojochao/emacsctl/errors"
+)
+
+func TestEnsureDir(t *testing.T) {
+	parent := t.TempDir()
+
+	t.Run("missing", func(t *testing.T) {
+		path := filepath.Join(parent, "missing", "nested")
+		if err := EnsureDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			t.Errorf("directory not created: %v", err)
+		}
+	})
+
+	t.Run("existing directory", func(t *testing.T) {
+		path := filepath.Join(parent, "dir")
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "keep"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := EnsureDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(path, "keep")); err != nil {
+			t.Errorf("content of existing directory lost: %v", err)
+		}
+	})
+
+	t.Run("existing file", func(t *testing.T) {
+		path := filepath.Join(parent, "file")
+		if err := os.WriteFile(path, []byte("not a directory"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var notDirErr errors.NotADirectoryError
+		if err := EnsureDir(path); !stderrors.As(err, &notDirErr) || notDirErr.Path != path {
+			t.Errorf("err = %v, want NotADirectoryError for %s", err, path)
+		}
+	})
+}
+
+func TestIsTerminal(t *testing.T) {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	if IsTerminal(devNull) {
+		t.Errorf("%s is a terminal, want not", os.DevNull)
+	}
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if IsTerminal(file) {
+		t.Error("regular file is a terminal, want not")
+	}
+}